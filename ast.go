@@ -23,54 +23,304 @@ freely, subject to the following restrictions:
 
 package rpn
 
-import "math/big"
+import (
+	"math/big"
+	"strconv"
+	"strings"
+)
 
-// Abstract syntax tree.
+// Abstract syntax tree. A value computed once and used in several places is
+// a LET node whose children are a STORE node, the child of which computes the
+// value, and the expression in which it is used, where it appears as RECALL
+// nodes. The Val of STORE and RECALL nodes is the value's *Binding. Similarly,
+// a SUM or PROD node's children are a FOR node, the children of which are the
+// bounds of the index, and the body, in which the index appears as RECALL
+// nodes; the Val of the FOR node is the index's *Binding. A TRY or DEFAULT
+// node's children are the operand which may fail and the value used if it
+// does.
 type AST struct {
 	Op       operator
 	Val      interface{}
 	Children []*AST
 	Parent   *AST
+	Span     Span
 }
 
-func getast(e *Evaluator, ops []operator) (int, *AST) {
+// The location of a node in the source from which it was compiled, as byte
+// offsets of its start and end. Nodes created by transformations have zero
+// spans. For expressions compiled from a Go AST, the offsets are token.Pos
+// values less one, which are correct for ASTs from parser.ParseExpr.
+type Span struct {
+	Pos, End int
+}
+
+// A named value shared by parts of an expression.
+type Binding struct {
+	Name string
+}
+
+// Build a tree from the end of ops. spans, if not nil, holds the span of each
+// op, of which ops is a prefix. binds holds the binding of each slot.
+func getast(e *Evaluator, ops []operator, spans []Span, binds []*Binding) (n int, nn *AST) {
+	defer func() {
+		if spans != nil && ops[len(ops)-1] != oNOP {
+			nn.Span = spans[len(ops)-1]
+		}
+	}()
 	switch op := ops[len(ops)-1]; op {
 	case oNOP:
-		n, nn := getast(e, ops[:len(ops)-1])
+		n, nn := getast(e, ops[:len(ops)-1], spans, binds)
 		return 1 + n, nn
 	case oLOAD:
-		nn := &AST{op, e.Names[len(e.Names)-e.N-1], nil, nil}
+		nn := &AST{op, e.Names[len(e.Names)-e.N-1], nil, nil, Span{}}
 		e.N++
 		return 1, nn
 	case oCONST:
-		nn := &AST{op, e.Consts[len(e.Consts)-e.C-1], nil, nil}
-		if r, ok := nn.Val.(*big.Rat); ok && r != nil && r.IsInt() {
-			nn.Val = r.Num()
+		// Copy the constant so that transformations on the tree cannot modify
+		// the expression it came from.
+		nn := &AST{op, nil, nil, nil, Span{}}
+		if r := e.Consts[len(e.Consts)-e.C-1]; r != nil {
+			nn.Val = constVal(r)
 		}
 		e.C++
 		return 1, nn
+	case oRECALL:
+		nn := &AST{op, binds[e.Slots[len(e.Slots)-e.T-1]], nil, nil, Span{}}
+		e.T++
+		return 1, nn
+	case oSTORE:
+		b := binds[e.Slots[len(e.Slots)-e.T-1]]
+		e.T++
+		n, child := getast(e, ops[:len(ops)-1], spans, binds)
+		nn := &AST{Op: op, Val: b, Children: []*AST{child}}
+		child.Parent = nn
+		return 1 + n, nn
+	case oFOR:
+		b := binds[e.Slots[len(e.Slots)-e.T-1]]
+		e.T++
+		n1, child1 := getast(e, ops[:len(ops)-1], spans, binds)
+		n2, child2 := getast(e, ops[:len(ops)-n1-1], spans, binds)
+		nn := &AST{Op: op, Val: b, Children: []*AST{child2, child1}}
+		child1.Parent, child2.Parent = nn, nn
+		return 1 + n1 + n2, nn
 	case oABS, oNEG, oNOT, oDENOM, oINV, oNUM, oTRUNC, oFLOOR, oCEIL:
-		n, child := getast(e, ops[:len(ops)-1])
+		n, child := getast(e, ops[:len(ops)-1], spans, binds)
 		nn := &AST{Op: op, Children: []*AST{child}}
 		child.Parent = nn
 		return 1 + n, nn
+	case oADDN, oMIN, oMAX, oGCDN, oLCM, oCRT:
+		k := e.Counts[len(e.Counts)-e.A-1]
+		e.A++
+		nn := &AST{Op: op, Children: make([]*AST, k)}
+		n := 1
+		for i := k - 1; i >= 0; i-- {
+			m, child := getast(e, ops[:len(ops)-n], spans, binds)
+			nn.Children[i], child.Parent = child, nn
+			n += m
+		}
+		return n, nn
+	case oEND:
+		// TRY or DEFAULT x ELSE y END
+		n1, child1 := getast(e, ops[:len(ops)-1], spans, binds)
+		n2, child2 := getast(e, ops[:len(ops)-n1-2], spans, binds)
+		nn := &AST{Op: ops[len(ops)-n1-n2-3], Children: []*AST{child2, child1}}
+		child1.Parent, child2.Parent = nn, nn
+		return 3 + n1 + n2, nn
 	case oEXP:
-		n1, child1 := getast(e, ops[:len(ops)-1])
-		n2, child2 := getast(e, ops[:len(ops)-n1-1])
-		n3, child3 := getast(e, ops[:len(ops)-n2-n1-1])
+		n1, child1 := getast(e, ops[:len(ops)-1], spans, binds)
+		n2, child2 := getast(e, ops[:len(ops)-n1-1], spans, binds)
+		n3, child3 := getast(e, ops[:len(ops)-n2-n1-1], spans, binds)
 		nn := &AST{Op: op, Children: []*AST{child3, child2, child1}}
 		child1.Parent, child2.Parent, child3.Parent = nn, nn, nn
 		return 1 + n1 + n2 + n3, nn
 	default:
 		// binary operator
-		n1, child1 := getast(e, ops[:len(ops)-1])
-		n2, child2 := getast(e, ops[:len(ops)-n1-1])
+		n1, child1 := getast(e, ops[:len(ops)-1], spans, binds)
+		n2, child2 := getast(e, ops[:len(ops)-n1-1], spans, binds)
 		nn := &AST{Op: op, Children: []*AST{child2, child1}}
 		child1.Parent, child2.Parent = nn, nn
 		return 1 + n1 + n2, nn
 	}
 }
 
+// Get the number of values an operation leaves on the stack.
+func results(op operator) int {
+	switch op {
+	case oDIVMOD, oCRT:
+		return 2
+	case oEGCD:
+		return 3
+	}
+	return 1
+}
+
+// Find an operation with several results below the top level of a tree.
+func multiValue(root *AST) *AST {
+	var m *AST
+	for _, top := range root.Children {
+		for _, child := range top.Children {
+			walk(child, func(nn *AST) {
+				if m == nil && results(nn.Op) > 1 {
+					m = nn
+				}
+			})
+		}
+	}
+	return m
+}
+
+// Create a node with the given children, linking them to it.
+func newAST(op operator, val interface{}, children ...*AST) *AST {
+	nn := &AST{op, val, children, nil, Span{}}
+	for _, child := range children {
+		child.Parent = nn
+	}
+	return nn
+}
+
+// Create a constant node holding a copy of r, as an Int if it is integral.
+func constAST(r *big.Rat) *AST {
+	return &AST{oCONST, constVal(r), nil, nil, Span{}}
+}
+
+func constVal(r *big.Rat) interface{} {
+	if r.IsInt() {
+		return new(big.Int).Set(r.Num())
+	}
+	return new(big.Rat).Set(r)
+}
+
+// Deep copy a subtree. The copy has no parent. Values stored in the subtree
+// get new bindings, so that the copy and the original are independent.
+func (nn *AST) clone() *AST {
+	return nn.cloneWith(make(map[*Binding]*Binding))
+}
+
+func (nn *AST) cloneWith(binds map[*Binding]*Binding) *AST {
+	c := &AST{Op: nn.Op, Val: nn.Val, Span: nn.Span}
+	switch v := nn.Val.(type) {
+	case *big.Int:
+		c.Val = new(big.Int).Set(v)
+	case *big.Rat:
+		c.Val = new(big.Rat).Set(v)
+	case *Binding:
+		if nn.Op == oSTORE || nn.Op == oFOR {
+			binds[v] = &Binding{v.Name}
+		}
+		if b, ok := binds[v]; ok {
+			c.Val = b
+		}
+	}
+	if nn.Children != nil {
+		c.Children = make([]*AST, len(nn.Children))
+		for i, child := range nn.Children {
+			c.Children[i] = child.cloneWith(binds)
+			c.Children[i].Parent = c
+		}
+	}
+	return c
+}
+
+// Find the STORE or FOR node defining the binding a RECALL node uses, or nil
+// if it is not in the tree.
+func binder(nn *AST) *AST {
+	b := nn.Val
+	for p := nn.Parent; p != nil; p = p.Parent {
+		switch p.Op {
+		case oLET, oSUM, oPROD:
+			if p.Children[0].Val == b {
+				return p.Children[0]
+			}
+		}
+	}
+	return nil
+}
+
+// Copy a subtree with every stored value written out in each place it is
+// used, so that the copy has no LET, STORE, or RECALL nodes.
+func (nn *AST) inline() *AST {
+	return nn.inlineWith(make(map[*Binding]*AST))
+}
+
+func (nn *AST) inlineWith(vals map[*Binding]*AST) *AST {
+	switch nn.Op {
+	case oLET:
+		st := nn.Children[0]
+		vals[st.Val.(*Binding)] = st.Children[0].inlineWith(vals)
+		return nn.Children[1].inlineWith(vals)
+	case oRECALL:
+		if v, ok := vals[nn.Val.(*Binding)]; ok {
+			return v.clone()
+		}
+	}
+	if len(nn.Children) == 0 {
+		return nn.clone()
+	}
+	children := make([]*AST, len(nn.Children))
+	for i, child := range nn.Children {
+		children[i] = child.inlineWith(vals)
+	}
+	c := newAST(nn.Op, nn.Val, children...)
+	c.Span = nn.Span
+	return c
+}
+
+// Compile a subtree into its own expression.
+func (nn *AST) expr() *Expr {
+	e := new(Expr)
+	nn.RPN(e)
+	return e
+}
+
+// Get the slot of a binding, adding it if necessary.
+func (e *Expr) slot(b *Binding) int {
+	for i, c := range e.binds {
+		if c == b {
+			return i
+		}
+	}
+	e.binds = append(e.binds, b)
+	return len(e.binds) - 1
+}
+
+// Get names for each slot which differ from each other, from the names of
+// variables, and from the names of operations, so that they can be printed.
+func (e *Expr) bindNames() []string {
+	used := make(map[string]bool, len(e.names)+len(e.binds))
+	for _, name := range e.names {
+		used[name] = true
+	}
+	names := make([]string, len(e.binds))
+	for i, b := range e.binds {
+		base := b.Name
+		if base == "" {
+			base = "t"
+		}
+		name := base
+		for k := 1; used[name] || reserved(name); k++ {
+			name = base + "_" + strconv.Itoa(k)
+		}
+		used[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// Check whether a name would be lexed as something other than an identifier.
+func reserved(name string) bool {
+	_, ok := ops[strings.ToUpper(name)]
+	_, stk := stackWords[strings.ToUpper(name)]
+	_, _, v := variadicOp(name)
+	return ok || stk || v || name == "_" || strings.EqualFold(name, "<nil>")
+}
+
+// Replace an expression with a compiled tree.
+func (e *Expr) set(ast *AST) {
+	e.ops, e.names, e.consts, e.spans = e.ops[:0], e.names[:0], e.consts[:0], e.spans[:0]
+	e.slots, e.binds, e.counts = e.slots[:0], nil, e.counts[:0]
+	ast.RPN(e)
+}
+
 // Compile an AST back into an evaluable expression.
 func (nn *AST) RPN(e *Expr) {
 	switch nn.Op {
@@ -82,6 +332,25 @@ func (nn *AST) RPN(e *Expr) {
 		return
 	case oLOAD:
 		e.names = append(e.names, nn.Val.(string))
+	case oRECALL:
+		e.slots = append(e.slots, e.slot(nn.Val.(*Binding)))
+	case oSTORE, oFOR:
+		for _, child := range nn.Children {
+			child.RPN(e)
+		}
+		e.slots = append(e.slots, e.slot(nn.Val.(*Binding)))
+	case oADDN, oMIN, oMAX, oGCDN, oLCM, oCRT:
+		for _, child := range nn.Children {
+			child.RPN(e)
+		}
+		e.counts = append(e.counts, len(nn.Children))
+	case oTRY, oDEFAULT:
+		e.emit(nn.Op, nn.Span)
+		nn.Children[0].RPN(e)
+		e.emit(oELSE, nn.Span)
+		nn.Children[1].RPN(e)
+		e.emit(oEND, nn.Span)
+		return
 	case oCONST:
 		switch v := nn.Val.(type) {
 		case *big.Int:
@@ -98,5 +367,5 @@ func (nn *AST) RPN(e *Expr) {
 			child.RPN(e)
 		}
 	}
-	e.ops = append(e.ops, nn.Op)
+	e.emit(nn.Op, nn.Span)
 }
@@ -0,0 +1,163 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"context"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// The result of evaluating an expression with one set of variables in a
+// batch. If the expression has several results, Result is the last.
+type BatchResult struct {
+	Result *big.Rat
+	Err    error
+}
+
+// Evaluate the expression with each set of variables on the given number of
+// goroutines, or GOMAXPROCS if workers is less than 1. The result for each set
+// is at the same index as it, with any error evaluating it. If ctx is done
+// before every set is evaluated, the error is ctx.Err(), and the results of
+// sets not evaluated are zero.
+func (e *Expr) EvalBatch(ctx context.Context, vars []Vars, workers int) ([]BatchResult, error) {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	results := make([]BatchResult, len(vars))
+	done := ctx.Done()
+	var next, finished int64 = -1, 0
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var v Evaluator
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(vars) {
+					return
+				}
+				results[i] = e.evalBatch(&v, vars[i])
+				atomic.AddInt64(&finished, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if int(finished) < len(vars) {
+		return results, ctx.Err()
+	}
+	return results, nil
+}
+
+// Evaluate the expression with each set of variables received from vars, as
+// with EvalBatch, sending the results in the order the sets were received. At
+// most twice as many sets as workers are evaluated or waiting to be sent at
+// once. The results are closed after vars is closed and every result is sent,
+// or once ctx is done, after which vars is no longer received from.
+func (e *Expr) EvalStream(ctx context.Context, vars <-chan Vars, workers int) <-chan BatchResult {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	done := ctx.Done()
+	out := make(chan BatchResult, workers)
+	jobs := make(chan batchJob, workers)
+	// Where each result will be, in order.
+	pending := make(chan chan BatchResult, 2*workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			var v Evaluator
+			for j := range jobs {
+				j.out <- e.evalBatch(&v, j.vars)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		for {
+			select {
+			case <-done:
+				return
+			case vs, ok := <-vars:
+				if !ok {
+					return
+				}
+				c := make(chan BatchResult, 1)
+				select {
+				case pending <- c:
+				case <-done:
+					return
+				}
+				jobs <- batchJob{vs, c}
+			}
+		}
+	}()
+	go func() {
+		defer close(out)
+		for c := range pending {
+			// Every set sent to the workers is evaluated, even once ctx is
+			// done, so each result arrives.
+			r := <-c
+			select {
+			case out <- r:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// A set of variables to evaluate in a stream and where to send the result.
+type batchJob struct {
+	vars Vars
+	out  chan<- BatchResult
+}
+
+// Evaluate one set of variables in a batch using the worker's evaluator.
+func (e *Expr) evalBatch(v *Evaluator, vars Vars) BatchResult {
+	results, err := e.evalOn(v, vars)
+	if err != nil {
+		return BatchResult{Err: err}
+	}
+	return BatchResult{Result: results[len(results)-1]}
+}
+
+// Evaluate the program as with Expr.EvalBatch.
+func (p *Program) EvalBatch(ctx context.Context, vars []Vars, workers int) ([]BatchResult, error) {
+	return p.e.EvalBatch(ctx, vars, workers)
+}
+
+// Evaluate the program as with Expr.EvalStream.
+func (p *Program) EvalStream(ctx context.Context, vars <-chan Vars, workers int) <-chan BatchResult {
+	return p.e.EvalStream(ctx, vars, workers)
+}
@@ -0,0 +1,132 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"context"
+	"math/big"
+	"testing"
+)
+
+// Sets of variables for batch tests: x from 0 to n-1, with every third set
+// missing x.
+func batchVars(n int) []Vars {
+	vars := make([]Vars, n)
+	for i := range vars {
+		vars[i] = Vars{"x": int64(i)}
+		if i%3 == 2 {
+			vars[i] = Vars{"y": int64(i)}
+		}
+	}
+	return vars
+}
+
+// Check the result of evaluating 2*x+1 with the i'th set from batchVars.
+func checkBatch(t *testing.T, i int, r BatchResult) {
+	if i%3 == 2 {
+		if _, ok := r.Err.(MissingVar); !ok || r.Result != nil {
+			t.Errorf("set %d: got %v, %v; want missing var", i, r.Result, r.Err)
+		}
+		return
+	}
+	if r.Err != nil || r.Result.Cmp(big.NewRat(int64(2*i+1), 1)) != 0 {
+		t.Errorf("set %d: got %v, %v; want %d", i, r.Result, r.Err, 2*i+1)
+	}
+}
+
+func TestEvalBatch(t *testing.T) {
+	e, err := CompileGo("2*x + 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := batchVars(100)
+	for _, workers := range []int{0, 1, 7} {
+		results, err := e.EvalBatch(context.Background(), vars, workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(vars) {
+			t.Fatalf("%d workers: got %d results, want %d", workers, len(results), len(vars))
+		}
+		for i, r := range results {
+			checkBatch(t, i, r)
+		}
+	}
+}
+
+func TestEvalBatchCanceled(t *testing.T) {
+	e, err := CompileGo("2*x + 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err := e.EvalBatch(ctx, batchVars(100), 4)
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if len(results) != 100 {
+		t.Errorf("got %d results, want 100", len(results))
+	}
+}
+
+func TestEvalStream(t *testing.T) {
+	e, err := CompileGo("2*x + 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := batchVars(100)
+	in := make(chan Vars)
+	go func() {
+		defer close(in)
+		for _, v := range vars {
+			in <- v
+		}
+	}()
+	n := 0
+	for r := range e.Program().EvalStream(context.Background(), in, 3) {
+		checkBatch(t, n, r)
+		n++
+	}
+	if n != len(vars) {
+		t.Errorf("got %d results, want %d", n, len(vars))
+	}
+}
+
+func TestEvalStreamCanceled(t *testing.T) {
+	e, err := CompileGo("2*x + 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan Vars)
+	out := e.EvalStream(ctx, in, 2)
+	in <- Vars{"x": int64(0)}
+	checkBatch(t, 0, <-out)
+	cancel()
+	// The results close without vars being closed.
+	for r := range out {
+		t.Errorf("result %v, %v after cancel", r.Result, r.Err)
+	}
+}
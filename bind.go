@@ -0,0 +1,69 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import "math/big"
+
+// Create a new expression in which the given variables are constants, with
+// constant subexpressions folded. Values may have any type accepted by Eval;
+// integral values become integers, as constants do. Variables not in vars
+// remain variables. The receiver is not modified.
+func (e *Expr) Bind(vars map[string]interface{}) (*Expr, error) {
+	ast := e.AST()
+	if err := bind(ast, vars); err != nil {
+		return nil, err
+	}
+	foldConsts(ast)
+	r := new(Expr)
+	r.set(ast)
+	return r, nil
+}
+
+func bind(nn *AST, vars map[string]interface{}) error {
+	for _, child := range nn.Children {
+		if err := bind(child, vars); err != nil {
+			return err
+		}
+	}
+	if nn.Op != oLOAD {
+		return nil
+	}
+	name := nn.Val.(string)
+	v := vars[name]
+	if v == nil {
+		return nil
+	}
+	x, ok := number(v)
+	if !ok {
+		return BadVar{name, v}
+	}
+	nn.Op = oCONST
+	switch x := x.(type) {
+	case *big.Int:
+		nn.Val = x
+	case *big.Rat:
+		nn.Val = constVal(x)
+	}
+	return nil
+}
@@ -33,9 +33,13 @@ import (
 
 func main() {
 	args := os.Args[1:]
-	useRPN := false
-	if args[0] == "-rpn" {
-		useRPN = true
+	useRPN, explain := false, false
+	for len(args) > 0 && (args[0] == "-rpn" || args[0] == "-explain") {
+		if args[0] == "-rpn" {
+			useRPN = true
+		} else {
+			explain = true
+		}
 		args = args[1:]
 	}
 	vars := make(map[string]interface{})
@@ -53,18 +57,25 @@ func main() {
 	}
 	expr, err := f(args[0])
 	if err != nil {
-		if _, ok := err.(rpn.LargeStack); !ok {
-			panic(err)
-		}
-		fmt.Println(err)
+		panic(err)
 	}
 	fmt.Println(expr)
-	expr.Slify()
+	s := rpn.Simplifier{Explain: explain}
+	expr = s.Slify(expr)
+	for _, step := range s.Steps {
+		if useRPN {
+			fmt.Printf("%s: %v => %v\n", step.Rule, step.Before, step.After)
+		} else {
+			fmt.Printf("%s: %s => %s\n", step.Rule, step.Before.GoSyntax(), step.After.GoSyntax())
+		}
+	}
 	fmt.Println(expr)
-	var res *big.Rat
-	res, err = expr.Eval(vars)
+	var res []*big.Rat
+	res, err = expr.EvalAll(vars)
 	if err != nil {
 		panic(err)
 	}
-	fmt.Println(res.RatString())
+	for _, r := range res {
+		fmt.Println(r.RatString())
+	}
 }
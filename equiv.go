@@ -0,0 +1,221 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"math/big"
+	"math/rand"
+)
+
+// Number of random points at which to compare expressions which cannot be
+// compared exactly.
+const equivTrials = 256
+
+// The result of comparing two expressions with Equivalent.
+type Equivalence int
+
+const (
+	// The expressions differ at some assignment.
+	Unequal Equivalence = iota
+	// The expressions are equal wherever both are defined.
+	Equal
+	// The expressions are different rational functions, but no assignment
+	// was found at which both are defined and they differ.
+	Unknown
+)
+
+// Check whether two expressions are equal for all assignments of their
+// variables. Points at which either expression fails to evaluate are not
+// considered, so e.g. x/x is equivalent to 1.
+//
+// If both expressions are rational functions of their variables, or become
+// identical rational functions when their other operations are treated as
+// opaque, the answer is exact. Otherwise, they are compared by evaluating both
+// at many random rational points, which can wrongly report equivalence only
+// with very small probability. If the expressions differ, the returned map is
+// an assignment at which they do, suitable for use with Eval.
+func Equivalent(x, y *Expr) (Equivalence, map[string]interface{}) {
+	xs, ys := x.AST().Children, y.AST().Children
+	if len(xs) != 1 || len(ys) != 1 || results(xs[0].Op) > 1 || results(ys[0].Op) > 1 {
+		// Expressions with several results are compared only at random
+		// points.
+		if vars := differ(x, y); vars != nil {
+			return Unequal, vars
+		}
+		return Equal, nil
+	}
+	ex := &expander{DefaultMaxOps}
+	a, aok := toRatFunc(xs[0].inline(), ex)
+	b, bok := toRatFunc(ys[0].inline(), ex)
+	if ex.left < 0 {
+		aok, bok = false, false
+	}
+	// Whether the rational functions were compared and found to differ.
+	differs := false
+	if aok && bok {
+		if l, ok := a.num.times(b.den); ok {
+			if r, ok := b.num.times(a.den); ok {
+				if len(l.plus(r.scale(big.NewRat(-1, 1)))) == 0 {
+					return Equal, nil
+				}
+				differs = true
+			}
+		}
+	}
+	if vars := differ(x, y); vars != nil {
+		return Unequal, vars
+	}
+	if differs && a.pure && b.pure {
+		// Differing rational functions are unequal at all but finitely
+		// many points, but we failed to find one at which both are defined.
+		return Unknown, nil
+	}
+	return Equal, nil
+}
+
+// Search for an assignment at which x and y evaluate to different values.
+func differ(x, y *Expr) map[string]interface{} {
+	names := append(x.Vars(), y.Vars()...)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < equivTrials; i++ {
+		vars := samplePoint(rng, i, names)
+		r, err := x.EvalAll(vars)
+		if err != nil {
+			continue
+		}
+		s, err := y.EvalAll(vars)
+		if err != nil {
+			continue
+		}
+		if len(r) != len(s) {
+			return vars
+		}
+		for i := range r {
+			if r[i].Cmp(s[i]) != 0 {
+				return vars
+			}
+		}
+	}
+	return nil
+}
+
+// Choose the i'th point at which differ compares expressions. It alternates
+// between integer and rational points, widening the range as it goes.
+// Integers satisfy the integer-only operations.
+func samplePoint(rng *rand.Rand, i int, names []string) map[string]interface{} {
+	n := int64(2 + i/2)
+	vars := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		v := big.NewInt(rng.Int63n(2*n+1) - n)
+		if i&1 == 0 {
+			vars[name] = v
+		} else {
+			vars[name] = new(big.Rat).SetFrac(v, big.NewInt(1+rng.Int63n(n)))
+		}
+	}
+	return vars
+}
+
+// A quotient of polynomials. If pure is set, the only opaque factors are
+// variables.
+type ratFunc struct {
+	num, den poly
+	pure     bool
+}
+
+func toRatFunc(nn *AST, ex *expander) (ratFunc, bool) {
+	one := constPoly(big.NewRat(1, 1))
+	switch nn.Op {
+	case oLOAD:
+		return ratFunc{atomPoly(nn.clone()), one, true}, true
+	case oCONST:
+		if c := ratOf(nn.Val); c != nil {
+			return ratFunc{constPoly(c), one, true}, true
+		}
+	case oADD, oSUB:
+		a, aok := toRatFunc(nn.Children[0], ex)
+		b, bok := toRatFunc(nn.Children[1], ex)
+		if !aok || !bok {
+			return ratFunc{}, false
+		}
+		if nn.Op == oSUB {
+			b.num = b.num.scale(big.NewRat(-1, 1))
+		}
+		l, lok := a.num.times(b.den)
+		r, rok := b.num.times(a.den)
+		d, dok := a.den.times(b.den)
+		return ratFunc{l.plus(r), d, a.pure && b.pure}, lok && rok && dok
+	case oADDN:
+		// Compare as additions, without relinking the operands.
+		x := nn.Children[0]
+		for _, y := range nn.Children[1:] {
+			x = &AST{Op: oADD, Children: []*AST{x, y}}
+		}
+		return toRatFunc(x, ex)
+	case oNEG:
+		a, ok := toRatFunc(nn.Children[0], ex)
+		a.num = a.num.scale(big.NewRat(-1, 1))
+		return a, ok
+	case oMUL, oQUO:
+		a, aok := toRatFunc(nn.Children[0], ex)
+		b, bok := toRatFunc(nn.Children[1], ex)
+		if !aok || !bok {
+			return ratFunc{}, false
+		}
+		if nn.Op == oQUO {
+			if len(b.num) == 0 {
+				break
+			}
+			b.num, b.den = b.den, b.num
+		}
+		n, nok := a.num.times(b.num)
+		d, dok := a.den.times(b.den)
+		return ratFunc{n, d, a.pure && b.pure}, nok && dok
+	case oINV:
+		a, ok := toRatFunc(nn.Children[0], ex)
+		if len(a.num) == 0 {
+			break
+		}
+		a.num, a.den = a.den, a.num
+		return a, ok
+	case oEXP:
+		y, m := nn.Children[1], nn.Children[2]
+		if m.Op == oCONST && m.Val == nil && y.Op == oCONST {
+			if n, ok := y.Val.(*big.Int); ok && n.CmpAbs(big.NewInt(maxTerms)) < 0 {
+				a, ok := toRatFunc(nn.Children[0], ex)
+				k := int(n.Int64())
+				if k < 0 {
+					if len(a.num) == 0 {
+						break
+					}
+					a.num, a.den, k = a.den, a.num, -k
+				}
+				num, nok := a.num.pow(k)
+				den, dok := a.den.pow(k)
+				return ratFunc{num, den, a.pure}, ok && nok && dok
+			}
+		}
+	}
+	return ratFunc{atomPoly(ex.opaque(nn)), one, false}, true
+}
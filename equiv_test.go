@@ -0,0 +1,106 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestEquivalent(t *testing.T) {
+	cases := []struct {
+		x, y string
+		want Equivalence
+	}{
+		{"(x+1)*(x+1)", "x*x + 2*x + 1", Equal},
+		{"x/x", "1", Equal},
+		{"exp(x, -1)", "1/x", Equal},
+		{"abs(x)*abs(x)", "x*x", Equal},
+		// Zero to a negative power is never defined, so there is nothing
+		// to compare.
+		{"exp(0, -1)", "1", Equal},
+		{"exp(x-x, -1)", "inv(0)", Equal},
+		// Products too large to compare exactly are compared at points.
+		{"exp(x+y+z+1, 6) / exp(u+v+w+1, 6)", "exp(x+y+z+1, 6) / exp(u+v+w+1, 6)", Equal},
+		{"x", "x+1", Unequal},
+		{"exp(x, 2)", "x*x + 1", Unequal},
+		{"abs(x)", "x", Unequal},
+		{"exp(x, -1)", "exp(x, -2)", Unequal},
+		// These differ everywhere, but are defined nowhere the search looks.
+		{"1/" + sampledRoots(), "2/" + sampledRoots(), Unknown},
+	}
+	for _, c := range cases {
+		x, err := CompileGo(c.x)
+		if err != nil {
+			t.Fatal(c.x, err)
+		}
+		y, err := CompileGo(c.y)
+		if err != nil {
+			t.Fatal(c.y, err)
+		}
+		got, vars := Equivalent(x, y)
+		if got != c.want {
+			t.Errorf("Equivalent(%s, %s) = %v, want %v", c.x, c.y, got, c.want)
+			continue
+		}
+		if got != Unequal {
+			if vars != nil {
+				t.Errorf("Equivalent(%s, %s) gave an assignment %v", c.x, c.y, vars)
+			}
+			continue
+		}
+		r, err := x.Eval(vars)
+		if err != nil {
+			t.Errorf("%s at %v: %v", c.x, vars, err)
+			continue
+		}
+		s, err := y.Eval(vars)
+		if err != nil {
+			t.Errorf("%s at %v: %v", c.y, vars, err)
+			continue
+		}
+		if r.Cmp(s) == 0 {
+			t.Errorf("%s and %s are both %v at %v", c.x, c.y, r, vars)
+		}
+	}
+}
+
+// Write a polynomial in x which is zero at every point Equivalent tries when
+// comparing expressions in x.
+func sampledRoots() string {
+	rng := rand.New(rand.NewSource(1))
+	seen := make(map[string]bool)
+	var factors []string
+	for i := 0; i < equivTrials; i++ {
+		p := samplePoint(rng, i, []string{"x", "x"})["x"]
+		s := fmt.Sprint(p)
+		if !seen[s] {
+			seen[s] = true
+			factors = append(factors, "(x - ("+s+"))")
+		}
+	}
+	return "(" + strings.Join(factors, "*") + ")"
+}
@@ -23,7 +23,10 @@ freely, subject to the following restrictions:
 
 package rpn
 
-import "fmt"
+import (
+	"fmt"
+	"math/big"
+)
 
 type (
 	// A variable in the expression is not in those used for evaluation.
@@ -58,14 +61,100 @@ type (
 		Pos   int
 	}
 
+	// Words defined in RPN expand to too many tokens.
+	WordSizeError struct {
+		Name string
+		Pos  int
+	}
+
 	// An RPN token does not have enough arguments on the stack.
 	StackError struct {
 		Token string
 		Pos   int
 	}
 
-	// An RPN expression contains extra values.
+	// An expression has several results where one is needed.
 	LargeStack struct{}
+
+	// An RPN expression leaves no values on the stack.
+	EmptyStack struct{}
+
+	// Expanding an expression writes out too many operations.
+	ExpandSizeError struct{}
+
+	// A rewrite rule is malformed.
+	BadRule struct {
+		Rule, Why string
+	}
+
+	// Rewriting did not reach a fixed point.
+	RewriteLoop struct{}
+
+	// A variable has a value of unsupported type, or one which is not a
+	// number.
+	BadVar struct {
+		Name  string
+		Value interface{}
+	}
+
+	// A Resolver failed to look up a variable.
+	ResolveError struct {
+		Name string
+		Err  error
+	}
+
+	// A result cannot be converted exactly to an integer.
+	InexactError struct {
+		Value *big.Rat
+	}
+
+	// A binding is used incorrectly.
+	ScopeError struct {
+		Name, Why string
+		Pos       int
+	}
+
+	// A function definition is malformed.
+	DefError struct {
+		Name, Why string
+	}
+
+	// Calls to functions defined by formulas are nested too deeply.
+	CallDepthError struct {
+		Name string
+	}
+
+	// Calls to functions defined by formulas expand to too many operations.
+	CallSizeError struct {
+		Name string
+	}
+
+	// A variable of a substituted expression has a name used elsewhere.
+	NameCollision struct {
+		Name string
+	}
+
+	// An operation with several results is used where one value is needed.
+	MultiValue struct {
+		Name string
+		Pos  int
+	}
+
+	// Congruences have no common solution.
+	NoSolution struct{}
+
+	// A TRY or DEFAULT block in RPN is not closed, or an ELSE or END does not
+	// end a block with one value.
+	BlockError struct {
+		Word string
+		Pos  int
+	}
+
+	// An operand is statically known to have the wrong type.
+	StaticTypeError struct {
+		Needed string
+		Span   Span
+	}
 )
 
 func (m MissingVar) Error() string  { return "missing var " + m.Name }
@@ -78,4 +167,41 @@ func (b BadRPNToken) Error() string { return fmt.Sprintf("bad token %s at positi
 func (s StackError) Error() string {
 	return fmt.Sprintf("insufficient arguments to %s before position %d", s.Token, s.Pos)
 }
-func (LargeStack) Error() string { return "expression ends with multiple values on stack" }
+func (LargeStack) Error() string  { return "expression ends with multiple values on stack" }
+func (EmptyStack) Error() string  { return "expression ends with no values on stack" }
+func (ExpandSizeError) Error() string {
+	return "expansion has too many operations"
+}
+func (b BadRule) Error() string   { return fmt.Sprintf("bad rule %q: %s", b.Rule, b.Why) }
+func (RewriteLoop) Error() string { return "rewrite rules do not terminate" }
+func (b BadVar) Error() string {
+	return fmt.Sprintf("bad value %v of type %T for var %s", b.Value, b.Value, b.Name)
+}
+func (r ResolveError) Error() string {
+	return "resolving " + r.Name + ": " + r.Err.Error()
+}
+func (i InexactError) Error() string {
+	return "inexact conversion of " + i.Value.RatString()
+}
+func (s ScopeError) Error() string {
+	return fmt.Sprintf("binding %s %s at position %d", s.Name, s.Why, s.Pos)
+}
+func (d DefError) Error() string {
+	return fmt.Sprintf("bad definition of function %s: %s", d.Name, d.Why)
+}
+func (c CallDepthError) Error() string { return "calls to " + c.Name + " nested too deeply" }
+func (c CallSizeError) Error() string  { return "calls to " + c.Name + " expand to too many operations" }
+func (n NameCollision) Error() string { return "name collision on var " + n.Name }
+func (s StaticTypeError) Error() string {
+	return fmt.Sprintf("incorrect type at position %d; needed %s", s.Span.Pos, s.Needed)
+}
+func (m MultiValue) Error() string {
+	return fmt.Sprintf("multiple-value %s in single-value context at position %d", m.Name, m.Pos)
+}
+func (NoSolution) Error() string { return "congruences have no solution" }
+func (w WordSizeError) Error() string {
+	return fmt.Sprintf("word %s at position %d expands to too many tokens", w.Name, w.Pos)
+}
+func (b BlockError) Error() string {
+	return fmt.Sprintf("misplaced %s at position %d", b.Word, b.Pos)
+}
@@ -0,0 +1,343 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"math"
+	"math/big"
+)
+
+// Bit length assumed for variables without given sizes.
+const DefaultVarBits = 64
+
+const maxInt = int(^uint(0) >> 1)
+
+// Predicted sizes of values and cost of evaluating an expression. The bit
+// length of a fraction is the larger of those of its numerator and
+// denominator. Bounds which do not fit in an int are the largest int.
+type Estimate struct {
+	// Upper bound on the bit length of the result, or of the largest result
+	// of an expression with several.
+	Bits int
+	// Upper bound on the bit length of any value computed.
+	MaxBits int
+	// Upper bounds on the bit length of each value computed, in evaluation
+	// order.
+	Values []int
+	// Estimated cost of evaluation, in operations on machine words.
+	Cost float64
+}
+
+type estimator struct {
+	bits  map[string]int
+	types map[*AST]Type
+	binds map[*Binding]int
+	est   Estimate
+}
+
+// Estimate the sizes of values and cost of evaluation before evaluating the
+// expression. varBits gives the bit length of each variable; others have
+// DefaultVarBits.
+func (e *Expr) Estimate(varBits map[string]int) Estimate {
+	root := e.AST()
+	types, _ := Infer(root, nil)
+	est := estimator{bits: varBits, types: types, binds: make(map[*Binding]int)}
+	for _, nn := range root.Children {
+		est.est.Bits = imax(est.est.Bits, est.estimate(nn))
+	}
+	return est.est
+}
+
+func (est *estimator) estimate(nn *AST) int {
+	b := make([]int, len(nn.Children))
+	costs := make([]float64, len(nn.Children))
+	for i, child := range nn.Children {
+		c := est.est.Cost
+		b[i] = est.estimate(child)
+		costs[i] = est.est.Cost - c
+	}
+	var bits int
+	var cost float64
+	switch nn.Op {
+	case oLOAD:
+		var ok bool
+		if bits, ok = est.bits[nn.Val.(string)]; !ok {
+			bits = DefaultVarBits
+		}
+		cost = words(bits)
+	case oCONST:
+		if c := ratOf(nn.Val); c != nil {
+			bits = ratBits(c)
+		}
+		cost = words(bits)
+	case oSTORE:
+		// Stored values are copied in and out.
+		bits = b[0]
+		est.binds[nn.Val.(*Binding)] = bits
+		cost = words(bits)
+	case oRECALL:
+		bits = est.binds[nn.Val.(*Binding)]
+		cost = words(bits)
+	case oLET:
+		bits = b[1]
+	case oFOR:
+		bits = imax(b[0], b[1])
+		est.binds[nn.Val.(*Binding)] = bits
+	case oSUM, oPROD:
+		// The body is evaluated once per index and was counted once.
+		lo, hi := nn.Children[0].Children[0], nn.Children[0].Children[1]
+		n := countRange(lo, hi, imin(b[0], 63))
+		rat := !est.isint(nn.Children[1])
+		switch {
+		case nn.Op == oPROD:
+			bits = satMul(b[1], n)
+		case rat:
+			// The denominator of a sum of fractions can be the product of
+			// theirs, and the numerator as large.
+			bits = satAdd(satMul(b[1], n), big.NewInt(int64(n)).BitLen())
+		default:
+			bits = satAdd(b[1], big.NewInt(int64(n)).BitLen())
+		}
+		cost = float64(imax(n-1, 0))*costs[1] + float64(n)*words(bits)
+		if rat {
+			cost += float64(n) * words(bits) * words(bits)
+		}
+	case oNEG, oABS, oINV, oNUM, oDENOM, oRSH:
+		bits = b[0]
+		cost = words(bits)
+	case oTRUNC, oFLOOR, oCEIL:
+		bits = satAdd(b[0], 1)
+		cost = words(bits) * words(bits)
+	case oNOT:
+		bits = satAdd(b[0], 1)
+		cost = words(bits)
+	case oADD, oSUB:
+		if est.isint(nn.Children[0]) && est.isint(nn.Children[1]) {
+			bits = satAdd(imax(b[0], b[1]), 1)
+			cost = words(bits)
+			break
+		}
+		// a/b + c/d = (ad + bc)/bd, reduced by a gcd.
+		bits = satAdd(satAdd(b[0], b[1]), 1)
+		cost = 3*words(b[0])*words(b[1]) + words(bits)*words(bits)
+	case oADDN:
+		// Operands are added in turn to the sum so far.
+		bits = b[0]
+		ints := est.isint(nn.Children[0])
+		for i, k := range b[1:] {
+			if ints = ints && est.isint(nn.Children[i+1]); ints {
+				bits = satAdd(imax(bits, k), 1)
+				cost += words(bits)
+				continue
+			}
+			// a/b + c/d = (ad + bc)/bd, reduced by a gcd.
+			w := words(satAdd(satAdd(bits, k), 1))
+			cost += 3*words(bits)*words(k) + w*w
+			bits = satAdd(satAdd(bits, k), 1)
+		}
+	case oMUL, oQUO:
+		bits = satAdd(b[0], b[1])
+		cost = words(b[0]) * words(b[1])
+		if !est.isint(nn.Children[0]) || !est.isint(nn.Children[1]) || nn.Op == oQUO {
+			cost += words(bits) * words(bits)
+		}
+	case oAND, oGCD:
+		// gcd(x, 0) is x, and x & y is as large as x if y is negative.
+		bits = imax(b[0], b[1])
+		cost = words(imax(b[0], b[1]))
+		if nn.Op == oGCD {
+			cost *= cost
+		}
+	case oMIN, oMAX, oTRY, oDEFAULT:
+		// Both operands of TRY and DEFAULT may be evaluated.
+		for _, k := range b {
+			bits = imax(bits, k)
+			cost += words(k)
+		}
+	case oGCDN, oLCM:
+		// Each operand is combined with the result so far by a gcd, and
+		// for lcm by a product and quotient as well.
+		bits = b[0]
+		for _, k := range b[1:] {
+			w := words(imax(bits, k))
+			cost += w * w
+			if nn.Op == oGCDN {
+				bits = imax(bits, k)
+			} else {
+				bits = satAdd(bits, k)
+				cost += words(bits) * words(k)
+			}
+		}
+	case oDIVMOD, oEGCD:
+		// The results are no larger than the operands, except that the
+		// coefficients from egcd are bounded by the other operand.
+		bits = imax(b[0], b[1])
+		cost = words(b[0]) * words(b[1])
+		if nn.Op == oEGCD {
+			cost *= 2 * words(bits)
+		}
+	case oCRT:
+		// The solution is less than the product of the moduli.
+		for i := 1; i < len(b); i += 2 {
+			bits = satAdd(bits, b[i])
+			cost += words(bits) * words(bits)
+		}
+	case oOR, oXOR, oANDNOT:
+		bits = imax(b[0], b[1])
+		cost = words(bits)
+	case oDIV, oMOD, oREM, oMODINVERSE:
+		bits = b[1]
+		if nn.Op == oDIV {
+			bits = b[0]
+		}
+		cost = words(b[0]) * words(b[1])
+		if nn.Op == oMODINVERSE {
+			cost *= cost
+		}
+	case oLSH:
+		// Shifts of 64 bits or more overflow.
+		bits = satAdd(b[0], int(limitVal(nn.Children[1], imin(b[1], 64))))
+		cost = words(bits)
+	case oEXP:
+		bits, cost = est.exp(nn, b)
+	case oMULRANGE:
+		// The product of n integers of k bits has at most nk bits. Operands
+		// are limited to 63 bits.
+		n := countRange(nn.Children[0], nn.Children[1], imin(imax(b[0], b[1]), 63))
+		k := imin(imax(b[0], b[1]), 63)
+		bits = satMul(n, k)
+		cost = float64(n) * words(bits)
+	case oBINOMIAL:
+		// binomial(n, k) < 2**n, and is computed with k multiplications.
+		n := limitVal(nn.Children[0], imin(b[0], 63))
+		k := limitVal(nn.Children[1], imin(b[1], 63))
+		bits = satAdd(int(n), 1)
+		cost = float64(k) * words(bits)
+	}
+	est.est.Values = append(est.est.Values, bits)
+	est.est.MaxBits = imax(est.est.MaxBits, bits)
+	est.est.Cost += cost
+	return bits
+}
+
+func (est *estimator) exp(nn *AST, b []int) (int, float64) {
+	y := limitVal(nn.Children[1], imin(b[1], 63))
+	bits := satMul(b[0], int(y))
+	if m := nn.Children[2]; m.Op != oCONST || m.Val != nil {
+		// Square and multiply modulo m once per bit of the exponent. Negative
+		// exponents ignore the modulus, giving a fraction as large as the
+		// power of the inverse.
+		w := words(b[2])
+		if y, ok := nn.Children[1].Val.(*big.Int); !ok || y.Sign() < 0 {
+			return imax(b[2], bits), 4 * float64(b[1]) * w * w
+		}
+		return b[2], 4 * float64(b[1]) * w * w
+	}
+	w := words(bits)
+	// Squarings dominate, and the last costs as much as all before it.
+	return bits, 2 * w * w
+}
+
+func (est *estimator) isint(nn *AST) bool {
+	return est.types[nn] == TypeInt
+}
+
+// Get an upper bound on the absolute value of a node with at most the given
+// bit length, which must be at most 63.
+func limitVal(nn *AST, bits int) int64 {
+	if nn.Op == oCONST {
+		if n, ok := nn.Val.(*big.Int); ok && n.IsInt64() {
+			switch v := n.Int64(); {
+			case v >= 0:
+				return v
+			case v > math.MinInt64:
+				return -v
+			}
+			return math.MaxInt64
+		}
+	}
+	if bits >= 63 {
+		return math.MaxInt64
+	}
+	return 1<<uint(bits) - 1
+}
+
+// Get an upper bound on the number of integers from lo to hi, where the
+// operands have at most the given bit length.
+func countRange(lo, hi *AST, bits int) int {
+	if lo.Op == oCONST && hi.Op == oCONST {
+		a, aok := lo.Val.(*big.Int)
+		b, bok := hi.Val.(*big.Int)
+		if aok && bok {
+			n := new(big.Int).Sub(b, a)
+			switch {
+			case n.Sign() < 0:
+				return 0
+			case n.Cmp(big.NewInt(math.MaxInt32)) > 0:
+				return maxInt
+			}
+			return int(n.Int64()) + 1
+		}
+	}
+	if bits >= 62 {
+		return maxInt
+	}
+	return 1 << uint(bits+1)
+}
+
+func ratBits(r *big.Rat) int {
+	return imax(r.Num().BitLen(), r.Denom().BitLen())
+}
+
+func words(bits int) float64 {
+	return math.Ceil(float64(bits) / 64)
+}
+
+func satAdd(a, b int) int {
+	if a > maxInt-b {
+		return maxInt
+	}
+	return a + b
+}
+
+func satMul(a, b int) int {
+	if a != 0 && b > maxInt/a {
+		return maxInt
+	}
+	return a * b
+}
+
+func imin(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func imax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,45 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import "testing"
+
+// Negative exponents give fractions as large as the positive powers, with or
+// without a modulus.
+func TestEstimateNegativeExponent(t *testing.T) {
+	cases := []string{
+		"(x) -3 _ EXP",
+		"(x) -3 (m) EXP",
+	}
+	vars := map[string]int{"x": 60, "m": 8}
+	for _, src := range cases {
+		e, err := CompileRPN(src)
+		if err != nil {
+			t.Fatal(src, err)
+		}
+		if got := e.Estimate(vars).Bits; got < 3*60 {
+			t.Errorf("%s estimated %d bits, want at least %d", src, got, 3*60)
+		}
+	}
+}
@@ -25,25 +25,140 @@ package rpn
 
 import "math/big"
 
+// A source of variable values. Lookup returns a *big.Int, *big.Rat, or any
+// other value accepted by Eval, or an error. If the variable does not exist,
+// the error should be MissingVar.
+type Resolver interface {
+	Lookup(name string) (interface{}, error)
+}
+
+// A Resolver using a map from variable names to values.
+type Vars map[string]interface{}
+
+func (v Vars) Lookup(name string) (interface{}, error) {
+	if x, ok := v[name]; ok {
+		return x, nil
+	}
+	return nil, MissingVar{name}
+}
+
 // Evaluation context. This type is exported to allow eventual user-supplied
 // operations.
 type Evaluator struct {
-	Stack  []interface{}
-	Vars   map[string]interface{}
-	Names  []string
-	Consts []*big.Rat
-	N, C   int
+	Stack   []interface{}
+	Vars    Resolver
+	Names   []string
+	Consts  []*big.Rat
+	Slots   []int
+	Temps   []interface{}
+	Counts  []int
+	N, C, T int
+	A       int
+
+	ops      []operator
+	pc       int
+	loops    []loop
+	handlers []handler
+}
+
+// State of a TRY or DEFAULT being evaluated, to which evaluation returns if
+// its first operand fails: the op, and where it is in each stream.
+type handler struct {
+	op               operator
+	pc, stack, loops int
+	n, c, t, a       int
+}
+
+// State of a FOR being evaluated: the index and its final value, the sum or
+// product so far, the index's slot, and where the body begins in each stream.
+type loop struct {
+	i, hi          *big.Int
+	acc            interface{}
+	slot           int
+	pc, n, c, t, a int
 }
 
 func (e *Evaluator) eval(ops []operator) (err error) {
-	for _, op := range ops {
-		if err = opFuncs[op](e); err != nil {
+	e.ops = ops
+	e.handlers = e.handlers[:0]
+	for e.pc = 0; e.pc < len(ops); e.pc++ {
+		if err = opFuncs[ops[e.pc]](e); err != nil && !e.recover(err) {
 			return err
 		}
 	}
 	return nil
 }
 
+// Return to the innermost TRY or DEFAULT which catches an error, moving to
+// its ELSE. If none does, the result is false.
+func (e *Evaluator) recover(err error) bool {
+	for len(e.handlers) > 0 {
+		h := e.handlers[len(e.handlers)-1]
+		e.handlers = e.handlers[:len(e.handlers)-1]
+		_, missing := err.(MissingVar)
+		if _, ok := err.(ResolveError); ok || missing != (h.op == oDEFAULT) {
+			continue
+		}
+		e.Stack, e.loops = e.Stack[:h.stack], e.loops[:h.loops]
+		e.pc, e.N, e.C, e.T, e.A = h.pc, h.n, h.c, h.t, h.a
+		e.skipTo(oELSE)
+		return true
+	}
+	return false
+}
+
+// Count an op which is not evaluated in the streams it uses.
+func (e *Evaluator) pass(op operator) {
+	switch op {
+	case oLOAD:
+		e.N++
+	case oCONST:
+		e.C++
+	case oSTORE, oRECALL, oFOR:
+		e.T++
+	case oADDN, oMIN, oMAX, oGCDN, oLCM, oCRT:
+		e.A++
+	}
+}
+
+// Move past the body of a FOR to the SUM or PROD ending it.
+func (e *Evaluator) skip() {
+	depth := 0
+	for e.pc++; ; e.pc++ {
+		e.pass(e.ops[e.pc])
+		switch e.ops[e.pc] {
+		case oFOR:
+			depth++
+		case oSUM, oPROD:
+			if depth == 0 {
+				return
+			}
+			depth--
+		}
+	}
+}
+
+// Move past an operand of a TRY or DEFAULT to the ELSE or END ending it.
+func (e *Evaluator) skipTo(end operator) {
+	depth := 0
+	for e.pc++; ; e.pc++ {
+		e.pass(e.ops[e.pc])
+		switch e.ops[e.pc] {
+		case oTRY, oDEFAULT:
+			depth++
+		case oEND:
+			if depth == 0 {
+				return
+			}
+			depth--
+		case oELSE:
+			if depth == 0 && end == oELSE {
+				return
+			}
+		}
+	}
+}
+
 // Helper to get the top element on the stack.
 func (e *Evaluator) Top() interface{} {
 	return e.Stack[len(e.Stack)-1]
@@ -66,15 +181,21 @@ type opFunc func(*Evaluator) error
 var opFuncs = [...]opFunc{
 	oNOP: func(*Evaluator) error { return nil },
 	oLOAD: func(e *Evaluator) error {
-		v := e.Vars[e.Names[e.N]]
-		switch i := v.(type) {
-		case *big.Int:
-			e.Stack = append(e.Stack, new(big.Int).Set(i))
-		case *big.Rat:
-			e.Stack = append(e.Stack, new(big.Rat).Set(i))
-		default:
+		v, err := e.Vars.Lookup(e.Names[e.N])
+		if err != nil {
+			if _, ok := err.(MissingVar); ok {
+				return err
+			}
+			return ResolveError{e.Names[e.N], err}
+		}
+		if v == nil {
 			return MissingVar{e.Names[e.N]}
 		}
+		x, ok := number(v)
+		if !ok {
+			return BadVar{e.Names[e.N], v}
+		}
+		e.Stack = append(e.Stack, x)
 		e.N++
 		return nil
 	},
@@ -91,8 +212,8 @@ var opFuncs = [...]opFunc{
 		return nil
 	},
 	oABS: numericUnary("ABS", (*big.Int).Abs, (*big.Rat).Abs),
-	oADD: numericBinary("ADD", (*big.Int).Add, (*big.Rat).Add),
-	oMUL: numericBinary("MUL", (*big.Int).Mul, (*big.Rat).Mul),
+	oADD: opAdd,
+	oMUL: opMul,
 	oNEG: numericUnary("NEG", (*big.Int).Neg, (*big.Rat).Neg),
 	oQUO: func(e *Evaluator) error {
 		x := e.Pop()
@@ -170,6 +291,9 @@ var opFuncs = [...]opFunc{
 		}
 		invert := a.Sign() < 0
 		if invert {
+			if b.Sign() == 0 {
+				return DivByZero{}
+			}
 			c = nil
 		}
 		b.Exp(b, a.Abs(a), c)
@@ -249,6 +373,232 @@ var opFuncs = [...]opFunc{
 			e.SetTop(q)
 		}
 	}),
+	oSTORE: func(e *Evaluator) error {
+		e.Temps[e.Slots[e.T]] = copyNum(e.Top())
+		e.T++
+		return nil
+	},
+	oRECALL: func(e *Evaluator) error {
+		e.Stack = append(e.Stack, copyNum(e.Temps[e.Slots[e.T]]))
+		e.T++
+		return nil
+	},
+	oLET: func(e *Evaluator) error {
+		e.SetTop(e.Pop())
+		return nil
+	},
+	oFOR: func(e *Evaluator) error {
+		hi, ok := e.Pop().(*big.Int)
+		if !ok {
+			return TypeError{"int"}
+		}
+		lo, ok := e.Pop().(*big.Int)
+		if !ok {
+			return TypeError{"int"}
+		}
+		slot := e.Slots[e.T]
+		e.T++
+		if lo.Cmp(hi) > 0 {
+			// The sum of nothing is 0, and the product 1.
+			e.skip()
+			if e.ops[e.pc] == oSUM {
+				e.Stack = append(e.Stack, new(big.Int))
+			} else {
+				e.Stack = append(e.Stack, big.NewInt(1))
+			}
+			return nil
+		}
+		e.Temps[slot] = new(big.Int).Set(lo)
+		e.loops = append(e.loops, loop{lo, hi, nil, slot, e.pc, e.N, e.C, e.T, e.A})
+		return nil
+	},
+	oSUM:  loopOp(opAdd),
+	oPROD: loopOp(opMul),
+	oADDN: func(e *Evaluator) error {
+		n := e.Counts[e.A]
+		e.A++
+		for i := 1; i < n; i++ {
+			if err := opAdd(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	oMIN:  numericExtreme(-1),
+	oMAX:  numericExtreme(1),
+	oGCDN: integerVariadic(func(r, x *big.Int) { r.GCD(nil, nil, r, x) }),
+	oLCM: integerVariadic(func(r, x *big.Int) {
+		if r.Sign() == 0 || x.Sign() == 0 {
+			r.SetInt64(0)
+			return
+		}
+		g := new(big.Int).GCD(nil, nil, r, x)
+		r.Mul(r, new(big.Int).Quo(x, g)).Abs(r)
+	}),
+	oDIVMOD: func(e *Evaluator) error {
+		x, y, err := e.ints2()
+		if err != nil {
+			return err
+		}
+		if y.Sign() == 0 {
+			return DivByZero{}
+		}
+		q, r := new(big.Int).DivMod(x, y, new(big.Int))
+		e.Stack = append(e.Stack, q, r)
+		return nil
+	},
+	oEGCD: func(e *Evaluator) error {
+		x, y, err := e.ints2()
+		if err != nil {
+			return err
+		}
+		a, b := new(big.Int), new(big.Int)
+		g := new(big.Int).GCD(a, b, x, y)
+		e.Stack = append(e.Stack, g, a, b)
+		return nil
+	},
+	oTRY:     beginHandler(oTRY),
+	oDEFAULT: beginHandler(oDEFAULT),
+	oELSE: func(e *Evaluator) error {
+		// The first operand succeeded.
+		e.handlers = e.handlers[:len(e.handlers)-1]
+		e.skipTo(oEND)
+		return nil
+	},
+	oEND: func(e *Evaluator) error { return nil },
+	oCRT: func(e *Evaluator) error {
+		args := e.args()
+		for _, x := range args {
+			if _, ok := x.(*big.Int); !ok {
+				return TypeError{"int"}
+			}
+		}
+		// Merge each congruence into x mod m in turn.
+		x, m := new(big.Int), big.NewInt(1)
+		for i := 0; i < len(args); i += 2 {
+			r, n := args[i].(*big.Int), new(big.Int).Abs(args[i+1].(*big.Int))
+			if n.Sign() == 0 {
+				return DivByZero{}
+			}
+			u, g := new(big.Int), new(big.Int)
+			g.GCD(u, nil, m, n)
+			d := new(big.Int).Sub(r, x)
+			if new(big.Int).Rem(d, g).Sign() != 0 {
+				return NoSolution{}
+			}
+			// x + m*u*(r-x)/g satisfies both, with u the inverse of m/g
+			// mod n/g.
+			d.Quo(d, g).Mul(d, u).Mul(d, m)
+			m.Mul(m, n.Quo(n, g))
+			x.Add(x, d).Mod(x, m)
+		}
+		e.Stack = append(e.Stack, x, m)
+		return nil
+	},
+}
+
+func beginHandler(op operator) opFunc {
+	return func(e *Evaluator) error {
+		e.handlers = append(e.handlers, handler{op, e.pc, len(e.Stack), len(e.loops), e.N, e.C, e.T, e.A})
+		return nil
+	}
+}
+
+// Pop two integer operands.
+func (e *Evaluator) ints2() (x, y *big.Int, err error) {
+	b, a := e.Pop(), e.Pop()
+	x, aok := a.(*big.Int)
+	y, bok := b.(*big.Int)
+	if !aok || !bok {
+		return nil, nil, TypeError{"int"}
+	}
+	return x, y, nil
+}
+
+// Get the operands of a variadic op, removing them from the stack.
+func (e *Evaluator) args() []interface{} {
+	n := e.Counts[e.A]
+	e.A++
+	args := e.Stack[len(e.Stack)-n:]
+	e.Stack = e.Stack[:len(e.Stack)-n]
+	return args
+}
+
+// Create an op giving its least operand if dir is -1 or its greatest if 1.
+func numericExtreme(dir int) opFunc {
+	return func(e *Evaluator) error {
+		args := e.args()
+		r, rv := args[0], ratOf(args[0])
+		for _, x := range args[1:] {
+			if xv := ratOf(x); xv.Cmp(rv) == dir {
+				r, rv = x, xv
+			}
+		}
+		e.Stack = append(e.Stack, r)
+		return nil
+	}
+}
+
+// Create a variadic integer op which folds its operands into the first with
+// f.
+func integerVariadic(f func(r, x *big.Int)) opFunc {
+	return func(e *Evaluator) error {
+		args := e.args()
+		for _, x := range args {
+			if _, ok := x.(*big.Int); !ok {
+				return TypeError{"int"}
+			}
+		}
+		r := new(big.Int).Abs(args[0].(*big.Int))
+		for _, x := range args[1:] {
+			f(r, x.(*big.Int))
+		}
+		e.Stack = append(e.Stack, r)
+		return nil
+	}
+}
+
+var (
+	opAdd = numericBinary("ADD", (*big.Int).Add, (*big.Rat).Add)
+	opMul = numericBinary("MUL", (*big.Int).Mul, (*big.Rat).Mul)
+)
+
+// Create the op ending the body of a FOR, which combines the values of the
+// body with op and evaluates the body again for the next index.
+func loopOp(op opFunc) opFunc {
+	return func(e *Evaluator) error {
+		l := &e.loops[len(e.loops)-1]
+		if l.acc == nil {
+			l.acc = e.Pop()
+		} else {
+			e.Stack = append(e.Stack, l.acc, e.Pop())
+			if err := op(e); err != nil {
+				return err
+			}
+			l.acc = e.Pop()
+		}
+		if l.i.Cmp(l.hi) < 0 {
+			l.i.Add(l.i, big.NewInt(1))
+			e.Temps[l.slot] = new(big.Int).Set(l.i)
+			e.pc, e.N, e.C, e.T, e.A = l.pc, l.n, l.c, l.t, l.a
+			return nil
+		}
+		e.Stack = append(e.Stack, l.acc)
+		e.loops = e.loops[:len(e.loops)-1]
+		return nil
+	}
+}
+
+// Copy a value on the stack, so that operations on one do not affect the
+// other.
+func copyNum(v interface{}) interface{} {
+	switch x := v.(type) {
+	case *big.Int:
+		return new(big.Int).Set(x)
+	case *big.Rat:
+		return new(big.Rat).Set(x)
+	}
+	return v
 }
 
 func numericUnary(name string, ints func(_, _ *big.Int) *big.Int, rats func(_, _ *big.Rat) *big.Rat) opFunc {
@@ -397,7 +747,9 @@ func integerShift(_ string, f func(_, _ *big.Int, _ uint) *big.Int) opFunc {
 			_ = y.(*big.Rat)
 			return TypeError{"int"}
 		}
-		if toobiguint(a) || toobiguint(b) {
+		// Only the shift count is limited, so that a shift is the same as
+		// multiplying or dividing by a power of two.
+		if toobiguint(a) {
 			return OverflowError{}
 		}
 		f(b, b, uint(a.Uint64()))
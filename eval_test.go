@@ -0,0 +1,75 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"math/big"
+	"testing"
+)
+
+// Shifts limit only their count, so that they agree with multiplying and
+// dividing by powers of two, which Slify rewrites to them.
+func TestShiftSize(t *testing.T) {
+	huge := new(big.Int).Lsh(big.NewInt(3), 100)
+	cases := []struct {
+		src, same string
+		shift     operator
+	}{
+		{"(x|0) << 3", "(x|0) * 8", oLSH},
+		{"x >> 3", "div(x, 8)", oRSH},
+		{"-x >> 3", "div(-x, 8)", oRSH},
+	}
+	vars := map[string]interface{}{"x": huge}
+	for _, c := range cases {
+		e, err := CompileGo(c.src)
+		if err != nil {
+			t.Fatal(c.src, err)
+		}
+		f, err := CompileGo(c.same)
+		if err != nil {
+			t.Fatal(c.same, err)
+		}
+		s := f.Slify()
+		if !hasop(s.AST(), c.shift) {
+			t.Errorf("%s simplified to %v, which has no shift", c.same, s)
+		}
+		for _, g := range []*Expr{f, s} {
+			want, err := g.Eval(vars)
+			if err != nil {
+				t.Fatal(g, err)
+			}
+			got, err := e.Eval(vars)
+			if err != nil || got.Cmp(want) != 0 {
+				t.Errorf("%s at x=%v: got %v, %v; want %v from %v", c.src, huge, got, err, want, g)
+			}
+		}
+	}
+	e, err := CompileGo("1 << x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Eval(vars); err != (OverflowError{}) {
+		t.Errorf("1 << %v gave %v, want overflow", huge, err)
+	}
+}
@@ -0,0 +1,485 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+	"strconv"
+)
+
+// Expand the expression into a canonical sum of products. Multiplication is
+// distributed over addition and subtraction, EXP with a constant non-negative
+// exponent and no modulus is multiplied out, and like terms are collected.
+// Every other operation is kept as an opaque factor whose operands are
+// expanded in turn. Two expressions which differ only by such rearrangements
+// have the same String() after expansion. Shared values are written out in
+// each place they are used. The result is a new expression. If writing it out
+// takes more than DefaultMaxOps operations, the error is ExpandSizeError.
+func (e *Expr) Expand() (*Expr, error) {
+	ast := e.AST()
+	ex := &expander{DefaultMaxOps}
+	eachValue(ast, func(nn *AST) *AST {
+		nn = nn.inline()
+		foldConsts(nn)
+		return ex.expand(nn)
+	})
+	if ex.left < 0 {
+		return nil, ExpandSizeError{}
+	}
+	return ast.expr(), nil
+}
+
+// Expand the expression, then pull the greatest common rational factor of the
+// coefficients and the common powers of each factor out of the sum, giving a
+// new expression. The limit on size is the same as for Expand.
+func (e *Expr) Factor() (*Expr, error) {
+	ast := e.AST()
+	ex := &expander{DefaultMaxOps}
+	eachValue(ast, func(nn *AST) *AST {
+		nn = nn.inline()
+		foldConsts(nn)
+		return ex.toPoly(nn).factor(ex)
+	})
+	if ex.left < 0 {
+		return nil, ExpandSizeError{}
+	}
+	return ast.expr(), nil
+}
+
+// Replace each result of an expression, or each operand of a result which is
+// an operation with several, with f of it.
+func eachValue(root *AST, f func(*AST) *AST) {
+	for i, nn := range root.Children {
+		if results(nn.Op) > 1 {
+			eachValue(nn, f)
+			continue
+		}
+		root.Children[i] = f(nn)
+		root.Children[i].Parent = root
+	}
+}
+
+// Limit on the number of terms a product may expand into. Larger products are
+// left as opaque factors.
+const maxTerms = 1 << 12
+
+// An expansion in progress, with the number of operations it may still write
+// out. Powers written as products can be exponentially larger than the
+// expression they come from, so once the count is negative, expansion stops
+// and gives meaningless results.
+type expander struct {
+	left int
+}
+
+// A factor of a monomial: an opaque subexpression raised to a positive power.
+type factor struct {
+	key  string
+	atom *AST
+	pow  int
+}
+
+// A term of a polynomial: a rational coefficient times a monomial. The factors
+// of the monomial are sorted by key.
+type term struct {
+	coef *big.Rat
+	mono []factor
+}
+
+// A polynomial over opaque factors, with terms keyed by their monomials.
+type poly map[string]*term
+
+func (ex *expander) expand(nn *AST) *AST {
+	switch nn.Op {
+	case oLOAD, oCONST:
+		ex.left--
+		return nn.clone()
+	}
+	return ex.toPoly(nn).ast(ex)
+}
+
+func (ex *expander) toPoly(nn *AST) poly {
+	if ex.left < 0 {
+		return poly{}
+	}
+	switch nn.Op {
+	case oCONST:
+		if c := ratOf(nn.Val); c != nil {
+			return constPoly(c)
+		}
+	case oADD:
+		return ex.toPoly(nn.Children[0]).plus(ex.toPoly(nn.Children[1]))
+	case oADDN:
+		p := poly{}
+		for _, child := range nn.Children {
+			p = p.plus(ex.toPoly(child))
+		}
+		return p
+	case oSUB:
+		return ex.toPoly(nn.Children[0]).plus(ex.toPoly(nn.Children[1]).scale(big.NewRat(-1, 1)))
+	case oNEG:
+		return ex.toPoly(nn.Children[0]).scale(big.NewRat(-1, 1))
+	case oMUL:
+		if p, ok := ex.toPoly(nn.Children[0]).times(ex.toPoly(nn.Children[1])); ok {
+			return p
+		}
+	case oQUO:
+		if c, ok := ex.toPoly(nn.Children[1]).constant(); ok && c.Sign() != 0 {
+			return ex.toPoly(nn.Children[0]).scale(c.Inv(c))
+		}
+	case oINV:
+		if c, ok := ex.toPoly(nn.Children[0]).constant(); ok && c.Sign() != 0 {
+			return constPoly(c.Inv(c))
+		}
+	case oEXP:
+		y, m := nn.Children[1], nn.Children[2]
+		if m.Op == oCONST && m.Val == nil && y.Op == oCONST {
+			if n, ok := y.Val.(*big.Int); ok && n.Sign() >= 0 && n.Cmp(big.NewInt(maxTerms)) < 0 {
+				p := ex.toPoly(nn.Children[0])
+				if p.degree()*n.Int64() > int64(ex.left) {
+					// Writing out the power would take too many operations.
+					ex.left = -1
+					return poly{}
+				}
+				if p, ok := p.pow(int(n.Int64())); ok {
+					return p
+				}
+			}
+		}
+	}
+	return atomPoly(ex.opaque(nn))
+}
+
+// Copy a node which cannot be expanded, expanding its operands instead.
+func (ex *expander) opaque(nn *AST) *AST {
+	if len(nn.Children) == 0 {
+		return nn.clone()
+	}
+	children := make([]*AST, len(nn.Children))
+	for i, child := range nn.Children {
+		if child.Op == oFOR {
+			// The loop's index must stay bound to the same FOR as the
+			// body, so the FOR is never an atom copied on its own.
+			children[i] = ex.opaque(child)
+			continue
+		}
+		children[i] = ex.expand(child)
+	}
+	return newAST(nn.Op, nn.Val, children...)
+}
+
+func ratOf(val interface{}) *big.Rat {
+	switch v := val.(type) {
+	case *big.Int:
+		return new(big.Rat).SetInt(v)
+	case *big.Rat:
+		return new(big.Rat).Set(v)
+	}
+	return nil
+}
+
+func constPoly(c *big.Rat) poly {
+	p := poly{}
+	p.add(c, nil)
+	return p
+}
+
+func atomPoly(atom *AST) poly {
+	p := poly{}
+	p.add(big.NewRat(1, 1), []factor{{atom.expr().String(), atom, 1}})
+	return p
+}
+
+func monoKey(mono []factor) string {
+	var buf bytes.Buffer
+	for _, f := range mono {
+		buf.WriteString(f.key)
+		buf.WriteByte('^')
+		buf.WriteString(strconv.Itoa(f.pow))
+		buf.WriteByte(0)
+	}
+	return buf.String()
+}
+
+// Add c times mono to p in place.
+func (p poly) add(c *big.Rat, mono []factor) {
+	if c.Sign() == 0 {
+		return
+	}
+	k := monoKey(mono)
+	if t, ok := p[k]; ok {
+		t.coef.Add(t.coef, c)
+		if t.coef.Sign() == 0 {
+			delete(p, k)
+		}
+		return
+	}
+	p[k] = &term{new(big.Rat).Set(c), mono}
+}
+
+func (p poly) plus(q poly) poly {
+	r := make(poly, len(p)+len(q))
+	for _, t := range p {
+		r.add(t.coef, t.mono)
+	}
+	for _, t := range q {
+		r.add(t.coef, t.mono)
+	}
+	return r
+}
+
+func (p poly) scale(c *big.Rat) poly {
+	r := make(poly, len(p))
+	for _, t := range p {
+		r.add(new(big.Rat).Mul(t.coef, c), t.mono)
+	}
+	return r
+}
+
+func (p poly) times(q poly) (poly, bool) {
+	if len(p)*len(q) > maxTerms {
+		return nil, false
+	}
+	r := make(poly, len(p)*len(q))
+	for _, s := range p {
+		for _, t := range q {
+			r.add(new(big.Rat).Mul(s.coef, t.coef), mulMono(s.mono, t.mono))
+		}
+	}
+	return r, true
+}
+
+func (p poly) pow(n int) (poly, bool) {
+	r, ok := constPoly(big.NewRat(1, 1)), true
+	for b := p; n > 0 && ok; n >>= 1 {
+		if n&1 != 0 {
+			if r, ok = r.times(b); !ok {
+				break
+			}
+		}
+		if n > 1 {
+			b, ok = b.times(b)
+		}
+	}
+	return r, ok
+}
+
+// Get the value of p if it is constant.
+func (p poly) constant() (*big.Rat, bool) {
+	switch len(p) {
+	case 0:
+		return new(big.Rat), true
+	case 1:
+		if t, ok := p[""]; ok {
+			return new(big.Rat).Set(t.coef), true
+		}
+	}
+	return nil, false
+}
+
+func mulMono(a, b []factor) []factor {
+	r := make([]factor, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0].key < b[0].key:
+			r, a = append(r, a[0]), a[1:]
+		case a[0].key > b[0].key:
+			r, b = append(r, b[0]), b[1:]
+		default:
+			r = append(r, factor{a[0].key, a[0].atom, a[0].pow + b[0].pow})
+			a, b = a[1:], b[1:]
+		}
+	}
+	return append(append(r, a...), b...)
+}
+
+func degree(mono []factor) (d int) {
+	for _, f := range mono {
+		d += f.pow
+	}
+	return d
+}
+
+// Get the greatest degree of the terms of p.
+func (p poly) degree() (d int64) {
+	for _, t := range p {
+		if k := int64(degree(t.mono)); k > d {
+			d = k
+		}
+	}
+	return d
+}
+
+// Order terms by descending degree, then lexicographically by factors.
+func termLess(s, t *term) bool {
+	if ds, dt := degree(s.mono), degree(t.mono); ds != dt {
+		return ds > dt
+	}
+	for i := 0; i < len(s.mono) && i < len(t.mono); i++ {
+		f, g := s.mono[i], t.mono[i]
+		if f.key != g.key {
+			return f.key < g.key
+		}
+		if f.pow != g.pow {
+			return f.pow > g.pow
+		}
+	}
+	return len(s.mono) < len(t.mono)
+}
+
+func (p poly) sorted() []*term {
+	terms := make([]*term, 0, len(p))
+	for _, t := range p {
+		terms = append(terms, t)
+	}
+	sort.Slice(terms, func(i, j int) bool { return termLess(terms[i], terms[j]) })
+	return terms
+}
+
+// Convert p to a tree in canonical form.
+func (p poly) ast(ex *expander) *AST {
+	var root *AST
+	for _, t := range p.sorted() {
+		switch {
+		case root == nil:
+			root = ex.termAST(t.coef, t.mono)
+		case t.coef.Sign() < 0:
+			root = newAST(oSUB, nil, root, ex.termAST(new(big.Rat).Neg(t.coef), t.mono))
+		default:
+			root = newAST(oADD, nil, root, ex.termAST(t.coef, t.mono))
+		}
+	}
+	if root == nil {
+		return constAST(new(big.Rat))
+	}
+	return root
+}
+
+func (ex *expander) termAST(c *big.Rat, mono []factor) *AST {
+	ex.left--
+	for _, f := range mono {
+		ex.left -= f.pow * (countNodes(f.atom) + 1)
+	}
+	if ex.left < 0 {
+		return constAST(c)
+	}
+	var r *AST
+	neg := c.Cmp(big.NewRat(-1, 1)) == 0
+	if !neg && !eqone(c) {
+		r = constAST(c)
+	}
+	for _, f := range mono {
+		for i := 0; i < f.pow; i++ {
+			if r == nil {
+				r = f.atom.clone()
+			} else {
+				r = newAST(oMUL, nil, r, f.atom.clone())
+			}
+		}
+	}
+	switch {
+	case r == nil:
+		return constAST(c)
+	case neg:
+		return newAST(oNEG, nil, r)
+	}
+	return r
+}
+
+// Convert p to a tree with common factors pulled out.
+func (p poly) factor(ex *expander) *AST {
+	terms := p.sorted()
+	if len(terms) < 2 {
+		return p.ast(ex)
+	}
+	// The content is the gcd of the numerators over the lcm of the
+	// denominators, signed so that the leading term of the rest is positive.
+	num := new(big.Int).Set(terms[0].coef.Num())
+	den := new(big.Int).Set(terms[0].coef.Denom())
+	common := terms[0].mono
+	for _, t := range terms[1:] {
+		num.GCD(nil, nil, num.Abs(num), new(big.Int).Abs(t.coef.Num()))
+		g := new(big.Int).GCD(nil, nil, den, t.coef.Denom())
+		den.Mul(den, t.coef.Denom()).Quo(den, g)
+		common = commonMono(common, t.mono)
+	}
+	content := new(big.Rat).SetFrac(num, den)
+	if terms[0].coef.Sign() < 0 {
+		content.Neg(content)
+	}
+	if eqone(content) && len(common) == 0 {
+		return p.ast(ex)
+	}
+	rest := make(poly, len(p))
+	for _, t := range terms {
+		rest.add(new(big.Rat).Quo(t.coef, content), divMono(t.mono, common))
+	}
+	return newAST(oMUL, nil, ex.termAST(content, common), rest.ast(ex))
+}
+
+// Count the nodes of a tree.
+func countNodes(nn *AST) int {
+	n := 1
+	for _, child := range nn.Children {
+		n += countNodes(child)
+	}
+	return n
+}
+
+// Find the factors common to both monomials, with their least powers.
+func commonMono(a, b []factor) []factor {
+	var r []factor
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0].key < b[0].key:
+			a = a[1:]
+		case a[0].key > b[0].key:
+			b = b[1:]
+		default:
+			f := a[0]
+			if b[0].pow < f.pow {
+				f.pow = b[0].pow
+			}
+			r = append(r, f)
+			a, b = a[1:], b[1:]
+		}
+	}
+	return r
+}
+
+// Divide a by b, which must divide it.
+func divMono(a, b []factor) []factor {
+	r := make([]factor, 0, len(a))
+	for _, f := range a {
+		if len(b) > 0 && b[0].key == f.key {
+			f.pow -= b[0].pow
+			b = b[1:]
+		}
+		if f.pow > 0 {
+			r = append(r, f)
+		}
+	}
+	return r
+}
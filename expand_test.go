@@ -0,0 +1,99 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import "testing"
+
+// Expanded and factored expressions must evaluate as the original does.
+func TestExpandFactorSeries(t *testing.T) {
+	cases := []string{
+		"series(i, 1, n, i*i) + 1",
+		"series(i, 1, n, (i+1)*(i-1)) * (n+2)",
+		"prod(i, 1, n, i + n) - 3",
+		"series(i, 1, n, series(j, 1, i, i*j))",
+		"series(i, 1, n, prod(j, i, n, j + i) * (i+1)*(i+1))",
+		"prod(i, 1, n, series(j, 1, i, j) + i) * 2",
+	}
+	for _, src := range cases {
+		e, err := CompileGo(src)
+		if err != nil {
+			t.Fatal(src, err)
+		}
+		x, err := e.Expand()
+		if err != nil {
+			t.Fatal(src, err)
+		}
+		y, err := e.Factor()
+		if err != nil {
+			t.Fatal(src, err)
+		}
+		for _, n := range []int64{0, 1, 4} {
+			vars := map[string]interface{}{"n": n}
+			want, err := e.Eval(vars)
+			if err != nil {
+				t.Fatal(src, err)
+			}
+			for name, f := range map[string]*Expr{"Expand": x, "Factor": y} {
+				got, err := f.Eval(vars)
+				if err != nil || got.Cmp(want) != 0 {
+					t.Errorf("%s(%s) = %v at n=%d: got %v, %v; want %v", name, src, f, n, got, err, want)
+				}
+			}
+		}
+	}
+}
+
+// Powers of powers multiply out to products too large to write.
+func TestExpandSize(t *testing.T) {
+	cases := []struct {
+		src string
+		ok  bool
+	}{
+		{"exp(x, 300)", true},
+		{"exp(exp(x, 30), 30)", true},
+		{"exp(exp(x, 300), 300)", false},
+		{"abs(exp(exp(x, 300), 300)) + 1", false},
+		{"exp(exp(exp(x, 300), 300), 300)", false},
+		{"exp(abs(exp(x+1, 30)), 300)", false},
+	}
+	for _, c := range cases {
+		e, err := CompileGo(c.src)
+		if err != nil {
+			t.Fatal(c.src, err)
+		}
+		for name, f := range map[string]func() (*Expr, error){"Expand": e.Expand, "Factor": e.Factor} {
+			r, err := f()
+			switch {
+			case c.ok && err != nil:
+				t.Errorf("%s(%s) failed: %v", name, c.src, err)
+			case !c.ok && err == nil:
+				t.Errorf("%s(%s) gave %d ops, want an error", name, c.src, len(r.ops))
+			case !c.ok:
+				if _, ok := err.(ExpandSizeError); !ok {
+					t.Errorf("%s(%s) gave the wrong error: %v", name, c.src, err)
+				}
+			}
+		}
+	}
+}
@@ -29,56 +29,117 @@ import (
 	"math/big"
 )
 
-// A compiled expression.
+// A compiled expression. Methods which transform an expression give a new one,
+// leaving the receiver unchanged. See Program for evaluating one expression
+// concurrently.
 type Expr struct {
 	ops    []operator
 	names  []string
 	consts []*big.Rat
+	spans  []Span
+	slots  []int
+	binds  []*Binding
+	counts []int
 }
 
-// Evaluate an expression with variables given in vars.
+// Append an operation compiled from the given span of source.
+func (e *Expr) emit(op operator, sp Span) {
+	e.ops = append(e.ops, op)
+	e.spans = append(e.spans, sp)
+}
+
+// Evaluate an expression with variables given in vars. Values may be
+// *big.Int, *big.Rat, *big.Float, any integer or floating-point type, or
+// strings or json.Numbers in the syntax accepted by ParseConst. Floating-point
+// values are converted exactly; NaN and infinities are rejected. A value of
+// any other type is a BadVar error.
 func (e *Expr) Eval(vars map[string]interface{}) (result *big.Rat, err error) {
-	v := Evaluator{
-		Stack:  make([]interface{}, 0, len(e.ops)),
-		Vars:   vars,
-		Names:  e.names,
-		Consts: e.consts,
+	return e.EvalWith(Vars(vars))
+}
+
+// Evaluate an expression with variables looked up from r. Errors from r other
+// than MissingVar are returned as ResolveError. If the expression has several
+// results, the result is the last.
+func (e *Expr) EvalWith(r Resolver) (result *big.Rat, err error) {
+	results, err := e.EvalAllWith(r)
+	if err != nil {
+		return nil, err
 	}
-	if err = v.eval(e.ops); err != nil {
+	return results[len(results)-1], nil
+}
+
+// Evaluate an expression, giving each of its results in order. An RPN
+// expression has a result for each value it leaves on the stack, and a Go
+// expression one for each element of a tuple like a, b or one with several
+// results like divmod(a, b).
+func (e *Expr) EvalAll(vars map[string]interface{}) ([]*big.Rat, error) {
+	return e.EvalAllWith(Vars(vars))
+}
+
+// Evaluate an expression as with EvalAll, with variables looked up from r.
+func (e *Expr) EvalAllWith(r Resolver) ([]*big.Rat, error) {
+	return e.evalOn(new(Evaluator), r)
+}
+
+// Evaluate an expression using v, reusing the storage it has from evaluating
+// any expression before.
+func (e *Expr) evalOn(v *Evaluator, r Resolver) ([]*big.Rat, error) {
+	if cap(v.Stack) < len(e.ops) {
+		v.Stack = make([]interface{}, 0, len(e.ops))
+	}
+	if cap(v.Temps) < len(e.binds) {
+		v.Temps = make([]interface{}, len(e.binds))
+	}
+	v.Stack, v.Temps, v.loops = v.Stack[:0], v.Temps[:len(e.binds)], v.loops[:0]
+	v.Vars, v.Names, v.Consts, v.Slots, v.Counts = r, e.names, e.consts, e.slots, e.counts
+	v.N, v.C, v.T, v.A = 0, 0, 0, 0
+	if err := v.eval(e.ops); err != nil {
 		return nil, err
 	}
-	switch x := v.Top().(type) {
-	case *big.Int:
-		return new(big.Rat).SetFrac(x, big.NewInt(1)), nil
-	case *big.Rat:
-		return new(big.Rat).Set(x), nil
-	default:
-		panic("wrong type on stack! (return)")
+	results := make([]*big.Rat, len(v.Stack))
+	for i, x := range v.Stack {
+		switch x := x.(type) {
+		case *big.Int:
+			results[i] = new(big.Rat).SetFrac(x, big.NewInt(1))
+		case *big.Rat:
+			results[i] = new(big.Rat).Set(x)
+		default:
+			panic("wrong type on stack! (return)")
+		}
 	}
+	return results, nil
 }
 
-// Simplify the expression.
-func (e *Expr) Slify() {
-	ast := e.AST()
-	// The act of creating the AST removes all NOPs and extra stack.
-	foldConsts(ast.Children[0])
-	for redundant(ast) {
-		// The condition is doing the work.
-	}
-	e.ops, e.names, e.consts = e.ops[:0], e.names[:0], e.consts[:0]
-	ast.RPN(e)
+// Simplify the expression, giving a new one. This is equivalent to using a
+// Simplifier in Loose mode.
+func (e *Expr) Slify() *Expr {
+	return new(Simplifier).Slify(e)
 }
 
 // Get the expression AST. The root is a NOP node; actual operations should be
-// done on its child and recursively thence.
+// done on its children, one for each result, and recursively thence.
 func (e *Expr) AST() *AST {
 	v := &Evaluator{
 		Names:  e.names,
 		Consts: e.consts,
+		Slots:  e.slots,
+		Counts: e.counts,
+	}
+	spans := e.spans
+	if len(spans) != len(e.ops) {
+		spans = nil
+	}
+	root := &AST{oNOP, nil, nil, nil, Span{}}
+	for ops := e.ops; len(ops) > 0; {
+		if ops[len(ops)-1] == oNOP {
+			ops = ops[:len(ops)-1]
+			continue
+		}
+		n, nn := getast(v, ops, spans, e.binds)
+		ops = ops[:len(ops)-n]
+		root.Children = append([]*AST{nn}, root.Children...)
+		nn.Parent = root
 	}
-	_, nn := getast(v, e.ops)
-	root := &AST{oNOP, nil, []*AST{nn}, nil}
-	nn.Parent = root
 	return root
 }
 
@@ -97,7 +158,8 @@ func (e *Expr) Vars() []string {
 
 // Show the compiled RPN expression.
 func (e *Expr) String() string {
-	names, consts := e.names, e.consts
+	names, consts, slots, counts := e.names, e.consts, e.slots, e.counts
+	bnames := e.bindNames()
 	var buf bytes.Buffer
 	first := true
 	for _, op := range e.ops {
@@ -168,6 +230,33 @@ func (e *Expr) String() string {
 			s = "FLOOR"
 		case oCEIL:
 			s = "CEIL"
+		case oSTORE:
+			s, slots = "="+bnames[slots[0]], slots[1:]
+		case oRECALL:
+			s, slots = bnames[slots[0]], slots[1:]
+		case oLET:
+			// Scopes close implicitly.
+			continue
+		case oFOR:
+			s, slots = "FOR:"+bnames[slots[0]], slots[1:]
+		case oSUM:
+			s = "SUM"
+		case oPROD:
+			s = "PROD"
+		case oDIVMOD:
+			s = "DIVMOD"
+		case oEGCD:
+			s = "EGCD"
+		case oTRY:
+			s = "TRY"
+		case oDEFAULT:
+			s = "DEFAULT"
+		case oELSE:
+			s = "ELSE"
+		case oEND:
+			s = "END"
+		case oADDN, oMIN, oMAX, oGCDN, oLCM, oCRT:
+			s, counts = fmt.Sprintf("%s/%d", variadics[op], counts[0]), counts[1:]
 		default:
 			panic("unknown op!")
 		}
@@ -0,0 +1,260 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"go/ast"
+	"go/parser"
+	"strings"
+)
+
+// Default limit on the nesting of calls to functions defined by formulas.
+const DefaultCallDepth = 32
+
+// Default limit on the number of operations in an expression with calls to
+// functions defined by formulas expanded.
+const DefaultMaxOps = 1 << 16
+
+// A set of functions defined by formulas, which expressions compiled with the
+// set may call by name. Calls are replaced by the bodies of the functions when
+// they are compiled, with each argument computed once and bound to its
+// parameter. Functions may call other functions in the set, regardless of the
+// syntax in which either is defined. The zero value is an empty set.
+type Funcs struct {
+	defs map[string]*funcDef
+	// Limit on the nesting of calls, which bounds recursion. If zero,
+	// DefaultCallDepth is used.
+	MaxDepth int
+	// Limit on the number of operations in an expression once calls are
+	// expanded, which bounds functions which call others several times. If
+	// zero, DefaultMaxOps is used.
+	MaxOps int
+}
+
+type funcDef struct {
+	name   string
+	params []string
+	// Exactly one of the bodies is set.
+	goBody  ast.Expr
+	rpnBody string
+}
+
+// The context in which part of an expression is compiled.
+type env struct {
+	// Bindings in scope in Go syntax, innermost last.
+	binds []*Binding
+	funcs *Funcs
+	// Number of calls being inlined.
+	depth int
+}
+
+// Define a function in Go syntax, as in "f(x, y) = x*x + y". Names in the
+// body which are not parameters are variables.
+func (fs *Funcs) DefineGo(def string) error {
+	i := strings.Index(def, "=")
+	if i < 0 {
+		return DefError{"", "missing ="}
+	}
+	lhs, err := parser.ParseExpr(def[:i])
+	if err != nil {
+		return err
+	}
+	body, err := parseGoExpr(def[i+1:])
+	if err != nil {
+		return err
+	}
+	call, ok := lhs.(*ast.CallExpr)
+	if !ok {
+		return DefError{"", "left side is not a call"}
+	}
+	name, ok := call.Fun.(*ast.Ident)
+	if !ok {
+		return DefError{"", "function name is not an identifier"}
+	}
+	params := make([]string, len(call.Args))
+	for i, arg := range call.Args {
+		p, ok := arg.(*ast.Ident)
+		if !ok {
+			return DefError{name.Name, "parameter is not an identifier"}
+		}
+		params[i] = p.Name
+	}
+	return fs.define(&funcDef{name: name.Name, params: params, goBody: body})
+}
+
+// Define a function with the given parameters whose body is in RPN syntax.
+// Within the body, parameters are bare names, as with bindings, and
+// parenthesized names are variables.
+func (fs *Funcs) DefineRPN(name string, params []string, body string) error {
+	return fs.define(&funcDef{name: name, params: params, rpnBody: body})
+}
+
+// Check and add a definition. The body is compiled once, so that errors and
+// recursion are reported now rather than when the function is called.
+func (fs *Funcs) define(f *funcDef) error {
+	if nam, ok := lexIdent(f.name); !ok || nam != f.name || reserved(f.name) || builtin(f.name) {
+		return DefError{f.name, "name is not available"}
+	}
+	seen := make(map[string]bool, len(f.params))
+	for _, p := range f.params {
+		if nam, ok := lexIdent(p); !ok || nam != p || reserved(p) || seen[p] {
+			return DefError{f.name, "bad parameter " + p}
+		}
+		seen[p] = true
+	}
+	if fs.defs == nil {
+		fs.defs = make(map[string]*funcDef)
+	}
+	old := fs.defs[f.name]
+	fs.defs[f.name] = f
+	e := new(Expr)
+	params := f.bindings()
+	for _, b := range params {
+		e.emit(oCONST, Span{})
+		e.consts = append(e.consts, nil)
+		e.emit(oSTORE, Span{})
+		e.slots = append(e.slots, e.slot(b))
+	}
+	err := fs.call(e, f, params, env{funcs: fs}, Span{})
+	if err == nil {
+		if root := e.AST(); results(root.Children[0].Op) > 1 || multiValue(root) != nil {
+			err = DefError{f.name, "body does not give one value"}
+		}
+	}
+	if err != nil {
+		if old == nil {
+			delete(fs.defs, f.name)
+		} else {
+			fs.defs[f.name] = old
+		}
+		return err
+	}
+	return nil
+}
+
+// Check whether a name is that of a function in Go syntax.
+func builtin(name string) bool {
+	for _, f := range goBinders {
+		if f == name {
+			return true
+		}
+	}
+	for _, f := range goFuncs {
+		if f == name {
+			return true
+		}
+	}
+	return name == "coalesce"
+}
+
+// Get a function by name.
+func (fs *Funcs) get(name string) *funcDef {
+	if fs == nil {
+		return nil
+	}
+	return fs.defs[name]
+}
+
+// Compile an expression in Go syntax which may call functions in the set.
+func (fs *Funcs) CompileGo(expr string) (*Expr, error) {
+	nodes, err := parseGo(expr)
+	if err != nil {
+		return nil, err
+	}
+	return compileGo(nodes, fs)
+}
+
+// Compile an expression in RPN syntax which may call functions in the set. A
+// bare name which is not bound calls the function of that name, taking its
+// arguments from the stack.
+func (fs *Funcs) CompileRPN(expr string) (*Expr, error) {
+	return compileRPN(expr, fs)
+}
+
+// Create new bindings for the parameters of a function.
+func (f *funcDef) bindings() []*Binding {
+	params := make([]*Binding, len(f.params))
+	for i, p := range f.params {
+		params[i] = &Binding{p}
+	}
+	return params
+}
+
+// Compile the body of a call to f, the arguments of which have been compiled
+// and stored in order to params just before the body. span is the location of
+// the call, which the inlined body takes.
+func (fs *Funcs) call(e *Expr, f *funcDef, params []*Binding, en env, span Span) error {
+	max := fs.MaxDepth
+	if max == 0 {
+		max = DefaultCallDepth
+	}
+	if en.depth >= max {
+		return CallDepthError{f.name}
+	}
+	if err := fs.checkSize(e, f); err != nil {
+		return err
+	}
+	k := len(e.spans)
+	inner := env{params, fs, en.depth + 1}
+	if f.goBody != nil {
+		if err := goast(f.goBody, e, inner); err != nil {
+			return err
+		}
+		for range params {
+			e.emit(oLET, span)
+		}
+	} else {
+		scopes := make([]scope, len(params))
+		for i, b := range params {
+			scopes[i] = scope{b, 1, mark{}, false, false}
+		}
+		stack, err := rpnCompile(e, f.rpnBody, scopes, inner)
+		if err != nil {
+			return err
+		}
+		if stack != 1 {
+			return DefError{f.name, "body does not give one value"}
+		}
+	}
+	if err := fs.checkSize(e, f); err != nil {
+		return err
+	}
+	for i := k; i < len(e.spans); i++ {
+		e.spans[i] = span
+	}
+	return nil
+}
+
+// Check that an expression into which calls to f are being expanded is within
+// the limit on operations.
+func (fs *Funcs) checkSize(e *Expr, f *funcDef) error {
+	max := fs.MaxOps
+	if max == 0 {
+		max = DefaultMaxOps
+	}
+	if len(e.ops) > max {
+		return CallSizeError{f.name}
+	}
+	return nil
+}
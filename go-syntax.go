@@ -24,40 +24,125 @@ freely, subject to the following restrictions:
 package rpn
 
 import (
+	"bytes"
 	"go/ast"
 	"go/parser"
+	"go/scanner"
 	"go/token"
 	"math/big"
+	"strings"
 )
 
-// Compile an expression represented in Go syntax.
+// Compile an expression represented in Go syntax. The expression may be a
+// tuple like q, r, each element of which is a result. Calls to divmod, egcd,
+// and crt, which have several results, can only be elements of a tuple.
 func CompileGo(expr string) (*Expr, error) {
-	tree, err := parser.ParseExpr(expr)
+	nodes, err := parseGo(expr)
 	if err != nil {
 		return nil, err
 	}
-	return CompileGoAST(tree)
+	return compileGo(nodes, nil)
 }
 
 // Compile a Go AST representation of an expression.
 func CompileGoAST(node ast.Node) (*Expr, error) {
+	return compileGo([]ast.Node{node}, nil)
+}
+
+func compileGo(nodes []ast.Node, funcs *Funcs) (*Expr, error) {
 	exp := new(Expr)
-	err := goast(node, exp)
-	if err != nil {
+	for _, node := range nodes {
+		if err := goast(node, exp, env{funcs: funcs}); err != nil {
+			return nil, err
+		}
+	}
+	root := exp.AST()
+	if m := multiValue(root); m != nil {
+		return nil, MultiValue{goFuncs[m.Op], m.Span.Pos}
+	}
+	if _, err := Infer(root, nil); err != nil {
 		return nil, err
 	}
 	return exp, nil
 }
 
-func goast(node ast.Node, e *Expr) error {
+// Parse an expression or a tuple of expressions separated by commas.
+func parseGo(expr string) ([]ast.Node, error) {
+	var elems []string
+	depth, start := 0, 0
+	for i, c := range expr {
+		switch c {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				// Pad each element so that positions are relative to the
+				// whole expression.
+				elems = append(elems, strings.Repeat(" ", start)+expr[start:i])
+				start = i + 1
+			}
+		}
+	}
+	elems = append(elems, strings.Repeat(" ", start)+expr[start:])
+	nodes := make([]ast.Node, len(elems))
+	for i, elem := range elems {
+		node, err := parseGoExpr(elem)
+		if err != nil {
+			return nil, err
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+// Name which the keyword default is replaced with before parsing, so that it
+// can be the name of a function. It has the same length so that positions are
+// unchanged.
+const goDefault = "dEFAULT"
+
+// Parse an expression, allowing default as a function name.
+func parseGoExpr(expr string) (ast.Expr, error) {
+	src := []byte(expr)
+	fset := token.NewFileSet()
+	var s scanner.Scanner
+	s.Init(fset.AddFile("", fset.Base(), len(src)), src, nil, 0)
+	for {
+		pos, tok, _ := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.DEFAULT {
+			copy(src[fset.Position(pos).Offset:], goDefault)
+		}
+	}
+	return parser.ParseExpr(string(src))
+}
+
+func goast(node ast.Node, e *Expr, en env) error {
 	switch nn := node.(type) {
 	case *ast.Ident:
-		e.ops = append(e.ops, oLOAD)
+		for i := len(en.binds) - 1; i >= 0; i-- {
+			if en.binds[i].Name == nn.Name {
+				e.emit(oRECALL, goSpan(nn))
+				e.slots = append(e.slots, e.slot(en.binds[i]))
+				return nil
+			}
+		}
+		e.emit(oLOAD, goSpan(nn))
 		e.names = append(e.names, nn.Name)
+	case *ast.SelectorExpr:
+		name, ok := selector(nn)
+		if !ok {
+			return BadGoToken{}
+		}
+		e.emit(oLOAD, goSpan(nn))
+		e.names = append(e.names, name)
 	case *ast.BasicLit:
 		if nn.Kind == token.INT || nn.Kind == token.FLOAT {
 			if x, ok := new(big.Rat).SetString(nn.Value); ok {
-				e.ops = append(e.ops, oCONST)
+				e.emit(oCONST, goSpan(nn))
 				e.consts = append(e.consts, x)
 			} else {
 				panic("can this even happen?")
@@ -66,10 +151,10 @@ func goast(node ast.Node, e *Expr) error {
 			return TypeError{"int or float"}
 		}
 	case *ast.BinaryExpr:
-		if err := goast(nn.X, e); err != nil {
+		if err := goast(nn.X, e, en); err != nil {
 			return err
 		}
-		if err := goast(nn.Y, e); err != nil {
+		if err := goast(nn.Y, e, en); err != nil {
 			return err
 		}
 		op := oNOP
@@ -99,9 +184,9 @@ func goast(node ast.Node, e *Expr) error {
 		default:
 			panic("can this even happen?")
 		}
-		e.ops = append(e.ops, op)
+		e.emit(op, goSpan(nn))
 	case *ast.UnaryExpr:
-		if err := goast(nn.X, e); err != nil {
+		if err := goast(nn.X, e, en); err != nil {
 			return err
 		}
 		op := oNOP
@@ -115,9 +200,9 @@ func goast(node ast.Node, e *Expr) error {
 		default:
 			panic("can this even happen?")
 		}
-		e.ops = append(e.ops, op)
+		e.emit(op, goSpan(nn))
 	case *ast.ParenExpr:
-		if err := goast(nn.X, e); err != nil {
+		if err := goast(nn.X, e, en); err != nil {
 			return err
 		}
 	case *ast.CallExpr:
@@ -125,6 +210,16 @@ func goast(node ast.Node, e *Expr) error {
 			op := oNOP
 			m, n := -1, -1
 			switch ident.Name {
+			case "let":
+				return golet(nn, e, en)
+			case "sum":
+				return govariadic(nn, oADDN, e, en)
+			case "series":
+				return goseries(nn, oSUM, e, en)
+			case "prod":
+				return goseries(nn, oPROD, e, en)
+			case "try", goDefault, "coalesce":
+				return gofallback(nn, e, en)
 			case "abs":
 				op = oABS
 				n = 1
@@ -134,12 +229,32 @@ func goast(node ast.Node, e *Expr) error {
 			case "div":
 				op = oDIV
 				n = 2
+			case "divmod":
+				op = oDIVMOD
+				n = 2
+			case "egcd":
+				op = oEGCD
+				n = 2
+			case "crt":
+				if len(nn.Args)%2 != 0 {
+					return BadCall{len(nn.Args) + 1}
+				}
+				return govariadic(nn, oCRT, e, en)
 			case "exp":
 				op = oEXP
 				m, n = 2, 3
 			case "gcd":
+				if len(nn.Args) != 2 {
+					return govariadic(nn, oGCDN, e, en)
+				}
 				op = oGCD
 				n = 2
+			case "lcm":
+				return govariadic(nn, oLCM, e, en)
+			case "min":
+				return govariadic(nn, oMIN, e, en)
+			case "max":
+				return govariadic(nn, oMAX, e, en)
 			case "mod":
 				op = oMOD
 				n = 2
@@ -168,19 +283,22 @@ func goast(node ast.Node, e *Expr) error {
 				op = oCEIL
 				n = 1
 			default:
+				if f := en.funcs.get(ident.Name); f != nil {
+					return gocall(nn, f, e, en)
+				}
 				return BadGoToken{}
 			}
 			if n >= 0 {
 				if m < 0 {
-					if err := chkargs(nn, n, e); err != nil {
+					if err := chkargs(nn, n, e, en); err != nil {
 						return err
 					}
-					e.ops = append(e.ops, op)
+					e.emit(op, goSpan(nn))
 				} else {
-					if err := chkargs2(nn, m, n, e); err != nil {
+					if err := chkargs2(nn, m, n, e, en); err != nil {
 						return err
 					}
-					e.ops = append(e.ops, op)
+					e.emit(op, goSpan(nn))
 				}
 			}
 		} else {
@@ -192,33 +310,361 @@ func goast(node ast.Node, e *Expr) error {
 	return nil
 }
 
-func chkargs(nn *ast.CallExpr, n int, e *Expr) error {
+// Compile let(name, value, body). The binding is in scope only in the body,
+// where it may not be shadowed.
+func golet(nn *ast.CallExpr, e *Expr, en env) error {
+	if len(nn.Args) != 3 {
+		return BadCall{3}
+	}
+	b, err := gobind(nn.Args[0], nn.Args[1:2], e, en)
+	if err != nil {
+		return err
+	}
+	e.emit(oSTORE, goSpan(nn.Args[0]))
+	e.slots = append(e.slots, e.slot(b))
+	return gobody(nn, b, oLET, e, en)
+}
+
+// Compile series(i, lo, hi, body) or prod(i, lo, hi, body). The index is in
+// scope only in the body.
+func goseries(nn *ast.CallExpr, op operator, e *Expr, en env) error {
+	if len(nn.Args) != 4 {
+		return BadCall{4}
+	}
+	b, err := gobind(nn.Args[0], nn.Args[1:3], e, en)
+	if err != nil {
+		return err
+	}
+	e.emit(oFOR, goSpan(nn.Args[0]))
+	e.slots = append(e.slots, e.slot(b))
+	return gobody(nn, b, op, e, en)
+}
+
+// Check the name of a new binding and compile the values it depends on,
+// which may not use it.
+func gobind(name ast.Expr, vals []ast.Expr, e *Expr, en env) (*Binding, error) {
+	ident, ok := name.(*ast.Ident)
+	if !ok {
+		return nil, BadGoToken{}
+	}
+	pos := int(ident.Pos()) - 1
+	if ident.Name == "_" {
+		return nil, ScopeError{ident.Name, "is not a name", pos}
+	}
+	for _, b := range en.binds {
+		if b.Name == ident.Name {
+			return nil, ScopeError{ident.Name, "shadows an enclosing binding", pos}
+		}
+	}
+	k := len(e.names)
+	for _, v := range vals {
+		if err := goast(v, e, en); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range e.names[k:] {
+		if name == ident.Name {
+			return nil, ScopeError{ident.Name, "is used in its own value", pos}
+		}
+	}
+	return &Binding{ident.Name}, nil
+}
+
+// Compile the last argument of a call with a binding in scope, then the op
+// ending the binding's scope.
+func gobody(nn *ast.CallExpr, b *Binding, op operator, e *Expr, en env) error {
+	inner := en
+	inner.binds = append(en.binds[:len(en.binds):len(en.binds)], b)
+	if err := goast(nn.Args[len(nn.Args)-1], e, inner); err != nil {
+		return err
+	}
+	e.emit(op, goSpan(nn))
+	return nil
+}
+
+// Compile try(x, y), default(x, y), or coalesce(x, y, ...), which is
+// default(x, coalesce(y, ...)).
+func gofallback(nn *ast.CallExpr, e *Expr, en env) error {
+	op := oDEFAULT
+	switch nn.Fun.(*ast.Ident).Name {
+	case "try":
+		op = oTRY
+		fallthrough
+	case goDefault:
+		if len(nn.Args) != 2 {
+			return BadCall{2}
+		}
+	default:
+		if len(nn.Args) < 1 {
+			return BadCall{1}
+		}
+	}
+	sp := goSpan(nn)
+	for _, arg := range nn.Args[:len(nn.Args)-1] {
+		e.emit(op, sp)
+		if err := goast(arg, e, en); err != nil {
+			return err
+		}
+		e.emit(oELSE, sp)
+	}
+	if err := goast(nn.Args[len(nn.Args)-1], e, en); err != nil {
+		return err
+	}
+	for range nn.Args[1:] {
+		e.emit(oEND, sp)
+	}
+	return nil
+}
+
+// Compile a call to a function of any positive number of arguments.
+func govariadic(nn *ast.CallExpr, op operator, e *Expr, en env) error {
+	if len(nn.Args) < 1 {
+		return BadCall{1}
+	}
+	for _, arg := range nn.Args {
+		if err := goast(arg, e, en); err != nil {
+			return err
+		}
+	}
+	e.emit(op, goSpan(nn))
+	e.counts = append(e.counts, len(nn.Args))
+	return nil
+}
+
+// Compile a call to a function defined by a formula.
+func gocall(nn *ast.CallExpr, f *funcDef, e *Expr, en env) error {
+	if len(nn.Args) != len(f.params) {
+		return BadCall{len(f.params)}
+	}
+	params := f.bindings()
+	for i, arg := range nn.Args {
+		if err := goast(arg, e, en); err != nil {
+			return err
+		}
+		e.emit(oSTORE, goSpan(nn))
+		e.slots = append(e.slots, e.slot(params[i]))
+	}
+	return en.funcs.call(e, f, params, en, goSpan(nn))
+}
+
+// Get the dotted name of a field of a nested struct.
+func selector(node ast.Expr) (string, bool) {
+	switch nn := node.(type) {
+	case *ast.Ident:
+		return nn.Name, true
+	case *ast.SelectorExpr:
+		if x, ok := selector(nn.X); ok {
+			return x + "." + nn.Sel.Name, true
+		}
+	}
+	return "", false
+}
+
+// Get the span of a node parsed by parser.ParseExpr.
+func goSpan(node ast.Node) Span {
+	return Span{int(node.Pos()) - 1, int(node.End()) - 1}
+}
+
+func chkargs(nn *ast.CallExpr, n int, e *Expr, en env) error {
 	if len(nn.Args) != n {
 		return BadCall{n}
 	}
 	for i := 0; i < n; i++ {
-		if err := goast(nn.Args[i], e); err != nil {
+		if err := goast(nn.Args[i], e, en); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func chkargs2(nn *ast.CallExpr, m, n int, e *Expr) error {
+func chkargs2(nn *ast.CallExpr, m, n int, e *Expr, en env) error {
 	if len(nn.Args) < m || len(nn.Args) > n {
 		return BadCall{m}
 	}
 	for i := 0; i < n; i++ {
 		if i >= len(nn.Args) {
 			for i < n {
-				e.ops = append(e.ops, oCONST)
+				e.emit(oCONST, Span{})
 				e.consts = append(e.consts, nil)
 				i++
 			}
 			break
-		} else if err := goast(nn.Args[i], e); err != nil {
+		} else if err := goast(nn.Args[i], e, en); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// Binary operators in Go syntax, with their precedences.
+var goBinary = map[operator]struct {
+	tok  string
+	prec int
+}{
+	oMUL:    {"*", 5},
+	oQUO:    {"/", 5},
+	oREM:    {"%", 5},
+	oLSH:    {"<<", 5},
+	oRSH:    {">>", 5},
+	oAND:    {"&", 5},
+	oANDNOT: {"&^", 5},
+	oADD:    {"+", 4},
+	oSUB:    {"-", 4},
+	oOR:     {"|", 4},
+	oXOR:    {"^", 4},
+}
+
+// Functions in Go syntax.
+var goFuncs = map[operator]string{
+	oABS:        "abs",
+	oBINOMIAL:   "binomial",
+	oDIV:        "div",
+	oEXP:        "exp",
+	oGCD:        "gcd",
+	oMOD:        "mod",
+	oMODINVERSE: "modinv",
+	oMULRANGE:   "mulrange",
+	oDENOM:      "denom",
+	oINV:        "inv",
+	oNUM:        "num",
+	oTRUNC:      "trunc",
+	oFLOOR:      "floor",
+	oCEIL:       "ceil",
+	oADDN:       "sum",
+	oMIN:        "min",
+	oMAX:        "max",
+	oGCDN:       "gcd",
+	oLCM:        "lcm",
+	oDIVMOD:     "divmod",
+	oEGCD:       "egcd",
+	oCRT:        "crt",
+	oTRY:        "try",
+	oDEFAULT:    "default",
+}
+
+// Functions in Go syntax which bind names.
+var goBinders = map[operator]string{
+	oLET:  "let",
+	oSUM:  "series",
+	oPROD: "prod",
+}
+
+// Show the expression in Go syntax. Shared values are shown as
+// let(name, value, body).
+func (e *Expr) GoSyntax() string {
+	var buf bytes.Buffer
+	names := make(map[*Binding]string, len(e.binds))
+	for i, name := range e.bindNames() {
+		names[e.binds[i]] = name
+	}
+	for i, nn := range e.AST().Children {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		nn.goSyntax(&buf, names)
+	}
+	return buf.String()
+}
+
+// Get the precedence of a node in Go syntax. Unary expressions, including
+// negative constants, are 6; operands are 7.
+func goPrec(nn *AST) int {
+	if b, ok := goBinary[nn.Op]; ok {
+		return b.prec
+	}
+	switch nn.Op {
+	case oNEG, oNOT:
+		return 6
+	case oCONST:
+		switch r := ratOf(nn.Val); {
+		case r == nil:
+		case !r.IsInt():
+			// Fractions are written as quotients.
+			return 5
+		case r.Sign() < 0:
+			return 6
+		}
+	}
+	return 7
+}
+
+func (nn *AST) goSyntax(buf *bytes.Buffer, names map[*Binding]string) {
+	if b, ok := goBinary[nn.Op]; ok {
+		x, y := nn.Children[0], nn.Children[1]
+		goParen(buf, x, goPrec(x) < b.prec, names)
+		buf.WriteString(" " + b.tok + " ")
+		goParen(buf, y, goPrec(y) <= b.prec, names)
+		return
+	}
+	switch nn.Op {
+	case oLOAD:
+		buf.WriteString(nn.Val.(string))
+	case oRECALL:
+		buf.WriteString(names[nn.Val.(*Binding)])
+	case oLET, oSUM, oPROD:
+		st := nn.Children[0]
+		buf.WriteString(goBinders[nn.Op] + "(" + names[st.Val.(*Binding)])
+		for _, child := range st.Children {
+			buf.WriteString(", ")
+			child.goSyntax(buf, names)
+		}
+		buf.WriteString(", ")
+		nn.Children[1].goSyntax(buf, names)
+		buf.WriteByte(')')
+	case oCONST:
+		if r := ratOf(nn.Val); r == nil {
+			buf.WriteString("nil")
+		} else {
+			buf.WriteString(r.RatString())
+		}
+	case oDEFAULT:
+		// Nested defaults are written as coalesce.
+		if nn.Children[1].Op != oDEFAULT {
+			buf.WriteString("default(")
+		} else {
+			buf.WriteString("coalesce(")
+		}
+		for nn.Op == oDEFAULT {
+			nn.Children[0].goSyntax(buf, names)
+			buf.WriteString(", ")
+			nn = nn.Children[1]
+		}
+		nn.goSyntax(buf, names)
+		buf.WriteByte(')')
+	case oNEG, oNOT:
+		if nn.Op == oNEG {
+			buf.WriteByte('-')
+		} else {
+			buf.WriteByte('^')
+		}
+		x := nn.Children[0]
+		goParen(buf, x, goPrec(x) < 7, names)
+	default:
+		name, ok := goFuncs[nn.Op]
+		if !ok {
+			panic("unknown op!")
+		}
+		buf.WriteString(name + "(")
+		for i, child := range nn.Children {
+			if child.Op == oCONST && child.Val == nil {
+				// Omitted optional argument.
+				break
+			}
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			child.goSyntax(buf, names)
+		}
+		buf.WriteByte(')')
+	}
+}
+
+func goParen(buf *bytes.Buffer, nn *AST, paren bool, names map[*Binding]string) {
+	if paren {
+		buf.WriteByte('(')
+	}
+	nn.goSyntax(buf, names)
+	if paren {
+		buf.WriteByte(')')
+	}
+}
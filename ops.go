@@ -66,4 +66,32 @@ const (
 	oTRUNC
 	oFLOOR
 	oCEIL
+
+	// shared values
+	oSTORE  // slots stack will have slot in which to store top of stack
+	oRECALL // slots stack will have slot to load
+	oLET    // drop the value under the top of stack
+
+	// index ranges
+	oFOR  // slots stack will have slot of the index; evaluate to SUM or PROD once per index
+	oSUM  // add the values of the body
+	oPROD // multiply the values of the body
+
+	// variadic ops; counts stack will have the number of operands
+	oADDN
+	oMIN
+	oMAX
+	oGCDN
+	oLCM
+
+	// ops with several results, which may only be results of an expression
+	oDIVMOD // push quotient, then remainder
+	oEGCD   // push gcd, then coefficients of each operand giving it
+	oCRT    // variadic; push solution of congruences, then its modulus
+
+	// recovery ops; TRY or DEFAULT x ELSE y END gives y if x fails
+	oTRY     // begin x, which may fail with any error but a missing variable
+	oDEFAULT // begin x, which may fail with a missing variable
+	oELSE    // end x and begin y
+	oEND     // end y
 )
@@ -0,0 +1,96 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import "math/big"
+
+// A compiled expression which is safe to evaluate from many goroutines at
+// once. It holds its own copy of everything evaluation uses, and nothing
+// changes it once it is created.
+type Program struct {
+	e Expr
+}
+
+// Create a Program which evaluates the expression. The Program has its own
+// copy of the expression, so it is unaffected by anything done to e.
+func (e *Expr) Program() *Program {
+	p := &Program{Expr{
+		ops:    append([]operator(nil), e.ops...),
+		names:  append([]string(nil), e.names...),
+		consts: make([]*big.Rat, len(e.consts)),
+		spans:  append([]Span(nil), e.spans...),
+		slots:  append([]int(nil), e.slots...),
+		binds:  make([]*Binding, len(e.binds)),
+		counts: append([]int(nil), e.counts...),
+	}}
+	for i, c := range e.consts {
+		if c != nil {
+			p.e.consts[i] = new(big.Rat).Set(c)
+		}
+	}
+	for i, b := range e.binds {
+		p.e.binds[i] = &Binding{b.Name}
+	}
+	return p
+}
+
+// Get a new Expr which is a copy of the program, for transformations.
+func (p *Program) Expr() *Expr {
+	return p.e.AST().expr()
+}
+
+// Evaluate the program as with Expr.Eval.
+func (p *Program) Eval(vars map[string]interface{}) (*big.Rat, error) {
+	return p.e.Eval(vars)
+}
+
+// Evaluate the program as with Expr.EvalWith.
+func (p *Program) EvalWith(r Resolver) (*big.Rat, error) {
+	return p.e.EvalWith(r)
+}
+
+// Evaluate the program as with Expr.EvalAll.
+func (p *Program) EvalAll(vars map[string]interface{}) ([]*big.Rat, error) {
+	return p.e.EvalAll(vars)
+}
+
+// Evaluate the program as with Expr.EvalAllWith.
+func (p *Program) EvalAllWith(r Resolver) ([]*big.Rat, error) {
+	return p.e.EvalAllWith(r)
+}
+
+// Evaluate the program as with Expr.EvalStruct.
+func (p *Program) EvalStruct(v interface{}) (*big.Rat, error) {
+	return p.e.EvalStruct(v)
+}
+
+// Compute a list of the names of variables in the program.
+func (p *Program) Vars() []string {
+	return p.e.Vars()
+}
+
+// Show the program in RPN syntax.
+func (p *Program) String() string {
+	return p.e.String()
+}
@@ -0,0 +1,130 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+)
+
+// Transforming the expression a Program was made from must not affect the
+// Program, even while it is being evaluated. Run with -race.
+func TestProgramConcurrent(t *testing.T) {
+	e, err := CompileGo("let(t, x*x + y, t*t - sum(x, y, 1)) / (y + 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule, err := CompileRuleGo("a*a -> exp(a, 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := e.String()
+	p := e.Program()
+	want := func(x, y int64) *big.Rat {
+		r, err := e.Eval(map[string]interface{}{"x": x, "y": y})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	wants := make([]*big.Rat, 16)
+	for i := range wants {
+		wants[i] = want(int64(i), int64(i%5))
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	errs := make(chan error, 8)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				for i, r := range wants {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					got, err := p.Eval(map[string]interface{}{"x": int64(i), "y": int64(i % 5)})
+					if err != nil {
+						errs <- err
+						return
+					}
+					if got.Cmp(r) != 0 {
+						t.Errorf("x=%d y=%d: got %v, want %v", i, i%5, got, r)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		e.Slify()
+		if _, err := e.Expand(); err != nil {
+			t.Error(err)
+		}
+		if _, err := e.Factor(); err != nil {
+			t.Error(err)
+		}
+		if _, err := e.Rewrite(rule); err != nil {
+			t.Error(err)
+		}
+		if _, err := e.Bind(map[string]interface{}{"y": int64(i)}); err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if s := e.String(); s != src {
+		t.Errorf("expression changed from %s to %s", src, s)
+	}
+	if s := p.String(); s != src {
+		t.Errorf("program changed from %s to %s", src, s)
+	}
+}
+
+// A Program's Expr is a copy which can be transformed independently.
+func TestProgramExpr(t *testing.T) {
+	e, err := CompileRPN("x DUP * 1 +")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := e.Program()
+	b, err := p.Expr().Bind(map[string]interface{}{"x": int64(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := b.Eval(nil); err != nil || r.Cmp(big.NewRat(10, 1)) != 0 {
+		t.Errorf("bound program gave %v, %v; want 10", r, err)
+	}
+	if r, err := p.Eval(map[string]interface{}{"x": int64(2)}); err != nil || r.Cmp(big.NewRat(5, 1)) != 0 {
+		t.Errorf("program gave %v, %v; want 5", r, err)
+	}
+}
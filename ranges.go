@@ -0,0 +1,690 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+)
+
+// Bit length beyond which bounds are treated as unbounded.
+const maxRangeBits = 1 << 16
+
+// A set of values: an interval whose ends may be unbounded or excluded, known
+// to contain only integers if Int is set. The zero Range contains every value.
+type Range struct {
+	// Bounds of the interval, or nil if unbounded.
+	Lo, Hi *big.Rat
+	// Whether the bounds themselves are excluded.
+	LoOpen, HiOpen bool
+	Int            bool
+}
+
+// The range containing only x.
+func Exactly(x *big.Rat) Range {
+	return Range{Lo: x, Hi: x, Int: x.IsInt()}
+}
+
+// The range of values between lo and hi, inclusive. Either may be nil.
+func Between(lo, hi *big.Rat) Range {
+	return Range{Lo: lo, Hi: hi}
+}
+
+// The range of values greater than zero.
+func Positive() Range {
+	return Range{Lo: new(big.Rat), LoOpen: true}
+}
+
+// The range of values less than zero.
+func Negative() Range {
+	return Range{Hi: new(big.Rat), HiOpen: true}
+}
+
+// The range of values at least zero.
+func NonNegative() Range {
+	return Range{Lo: new(big.Rat)}
+}
+
+// The range of values at most zero.
+func NonPositive() Range {
+	return Range{Hi: new(big.Rat)}
+}
+
+// The integers in r.
+func (r Range) Integers() Range {
+	r.Int = true
+	return r.norm()
+}
+
+// Check whether x is in r.
+func (r Range) Contains(x *big.Rat) bool {
+	if r.Int && !x.IsInt() {
+		return false
+	}
+	if r.Lo != nil {
+		if c := x.Cmp(r.Lo); c < 0 || c == 0 && r.LoOpen {
+			return false
+		}
+	}
+	if r.Hi != nil {
+		if c := x.Cmp(r.Hi); c > 0 || c == 0 && r.HiOpen {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the sign of every value in r, if they all have the same sign.
+func (r Range) Sign() (int, bool) {
+	switch {
+	case r.lower().sign() > 0:
+		return 1, true
+	case r.upper().sign() < 0:
+		return -1, true
+	case r.zero():
+		return 0, true
+	}
+	return 0, false
+}
+
+func (r Range) zero() bool {
+	return r.Lo != nil && r.Hi != nil && r.Lo.Sign() == 0 && r.Hi.Sign() == 0
+}
+
+func (r Range) String() string {
+	var buf bytes.Buffer
+	switch {
+	case r.Lo == nil:
+		buf.WriteString("(-inf")
+	case r.LoOpen:
+		fmt.Fprintf(&buf, "(%s", r.Lo.RatString())
+	default:
+		fmt.Fprintf(&buf, "[%s", r.Lo.RatString())
+	}
+	switch {
+	case r.Hi == nil:
+		buf.WriteString(", +inf)")
+	case r.HiOpen:
+		fmt.Fprintf(&buf, ", %s)", r.Hi.RatString())
+	default:
+		fmt.Fprintf(&buf, ", %s]", r.Hi.RatString())
+	}
+	if r.Int {
+		buf.WriteString(" int")
+	}
+	return buf.String()
+}
+
+// Tighten the bounds of an integer range to integers.
+func (r Range) norm() Range {
+	if !r.Int {
+		return r
+	}
+	if r.Lo != nil {
+		lo := ceilRat(r.Lo)
+		if r.LoOpen && r.Lo.IsInt() {
+			lo.Add(lo, big.NewInt(1))
+		}
+		r.Lo, r.LoOpen = new(big.Rat).SetInt(lo), false
+	}
+	if r.Hi != nil {
+		hi := floorRat(r.Hi)
+		if r.HiOpen && r.Hi.IsInt() {
+			hi.Sub(hi, big.NewInt(1))
+		}
+		r.Hi, r.HiOpen = new(big.Rat).SetInt(hi), false
+	}
+	return r
+}
+
+// One end of an interval. Infinite ends have inf set to their sign. dir is
+// the direction from the bound into the interval.
+type bound struct {
+	v    *big.Rat
+	inf  int
+	open bool
+	dir  int
+}
+
+func (r Range) lower() bound {
+	if r.Lo == nil {
+		return bound{inf: -1, open: true, dir: 1}
+	}
+	return bound{r.Lo, 0, r.LoOpen, 1}
+}
+
+func (r Range) upper() bound {
+	if r.Hi == nil {
+		return bound{inf: 1, open: true, dir: -1}
+	}
+	return bound{r.Hi, 0, r.HiOpen, -1}
+}
+
+func fin(v *big.Rat) bound {
+	return bound{v: v}
+}
+
+func infb(sign int) bound {
+	return bound{inf: sign, open: true}
+}
+
+func fromBounds(lo, hi bound, isint bool) Range {
+	r := Range{Int: isint}
+	if lo.inf == 0 {
+		r.Lo, r.LoOpen = lo.v, lo.open
+	}
+	if hi.inf == 0 {
+		r.Hi, r.HiOpen = hi.v, hi.open
+	}
+	return r.norm()
+}
+
+// Get the sign of values just inside the bound.
+func (a bound) sign() int {
+	if a.inf != 0 {
+		return a.inf
+	}
+	if s := a.v.Sign(); s != 0 || !a.open {
+		return s
+	}
+	return a.dir
+}
+
+func (a bound) cmp(b bound) int {
+	switch {
+	case a.inf < b.inf:
+		return -1
+	case a.inf > b.inf:
+		return 1
+	case a.inf != 0:
+		return 0
+	}
+	return a.v.Cmp(b.v)
+}
+
+func minb(bs ...bound) bound {
+	m := bs[0]
+	for _, b := range bs[1:] {
+		if c := b.cmp(m); c < 0 || c == 0 && !b.open {
+			m = b
+		}
+	}
+	return m
+}
+
+func maxb(bs ...bound) bound {
+	m := bs[0]
+	for _, b := range bs[1:] {
+		if c := b.cmp(m); c > 0 || c == 0 && !b.open {
+			m = b
+		}
+	}
+	return m
+}
+
+func addb(a, b bound) bound {
+	switch {
+	case a.inf != 0:
+		return a
+	case b.inf != 0:
+		return b
+	}
+	return bound{v: new(big.Rat).Add(a.v, b.v), open: a.open || b.open}
+}
+
+func negb(a bound) bound {
+	if a.inf != 0 {
+		return infb(-a.inf)
+	}
+	return bound{v: new(big.Rat).Neg(a.v), open: a.open, dir: -a.dir}
+}
+
+// Get the limits of products of values near a and b.
+func mulb(a, b bound) []bound {
+	if a.inf == 0 && b.inf == 0 {
+		az, bz := a.v.Sign() == 0, b.v.Sign() == 0
+		open := a.open && (!bz || b.open) || b.open && (!az || a.open)
+		return []bound{{v: new(big.Rat).Mul(a.v, b.v), open: open}}
+	}
+	s := a.sign() * b.sign()
+	if s == 0 {
+		return []bound{fin(new(big.Rat))}
+	}
+	r := []bound{infb(s)}
+	if a.inf == 0 && a.v.Sign() == 0 || b.inf == 0 && b.v.Sign() == 0 {
+		// An excluded zero times an infinity may approach anything.
+		r = append(r, bound{v: new(big.Rat), open: true})
+	}
+	return r
+}
+
+func mulr(x, y Range) (lo, hi bound) {
+	var c []bound
+	for _, a := range []bound{x.lower(), x.upper()} {
+		for _, b := range []bound{y.lower(), y.upper()} {
+			c = append(c, mulb(a, b)...)
+		}
+	}
+	return minb(c...), maxb(c...)
+}
+
+func invb(a bound) bound {
+	switch {
+	case a.inf != 0:
+		return bound{v: new(big.Rat), open: true}
+	case a.v.Sign() == 0:
+		return infb(a.sign())
+	}
+	return bound{v: new(big.Rat).Inv(a.v), open: a.open}
+}
+
+// Get the range of reciprocals of values in y, if it excludes zero.
+func invr(y Range) (Range, bool) {
+	if y.lower().sign() > 0 || y.upper().sign() < 0 {
+		return fromBounds(invb(y.upper()), invb(y.lower()), false), true
+	}
+	return Range{}, false
+}
+
+func floorb(a bound) bound {
+	if a.inf != 0 {
+		return a
+	}
+	return fin(new(big.Rat).SetInt(floorRat(a.v)))
+}
+
+func ceilb(a bound) bound {
+	if a.inf != 0 {
+		return a
+	}
+	return fin(new(big.Rat).SetInt(ceilRat(a.v)))
+}
+
+func truncb(a bound) bound {
+	if a.inf == 0 && a.v.Sign() < 0 {
+		return ceilb(a)
+	}
+	return floorb(a)
+}
+
+// Raise a bound to a non-negative integer power.
+func powb(a bound, n int) bound {
+	if n == 0 {
+		return fin(big.NewRat(1, 1))
+	}
+	s := a.sign()
+	if n%2 == 0 && s < 0 {
+		s = -s
+	}
+	if a.inf != 0 || (a.v.Num().BitLen()+a.v.Denom().BitLen())*n > maxRangeBits {
+		return infb(s)
+	}
+	k := big.NewInt(int64(n))
+	num := new(big.Int).Exp(a.v.Num(), k, nil)
+	den := new(big.Int).Exp(a.v.Denom(), k, nil)
+	return bound{v: new(big.Rat).SetFrac(num, den), open: a.open}
+}
+
+// Get 2**a for an integer bound, with huge values taken as infinite.
+func pow2b(a bound) bound {
+	switch {
+	case a.inf > 0, a.inf == 0 && a.v.Num().CmpAbs(big.NewInt(maxRangeBits)) > 0 && a.v.Sign() > 0:
+		return infb(1)
+	case a.inf < 0, a.inf == 0 && a.v.Num().CmpAbs(big.NewInt(maxRangeBits)) > 0:
+		return fin(new(big.Rat))
+	}
+	n := a.v.Num().Int64()
+	if n < 0 {
+		return fin(new(big.Rat).SetFrac(big.NewInt(1), new(big.Int).Lsh(big.NewInt(1), uint(-n))))
+	}
+	return fin(new(big.Rat).SetInt(new(big.Int).Lsh(big.NewInt(1), uint(n))))
+}
+
+// Get the largest absolute value in r.
+func absmax(r Range) bound {
+	return maxb(negb(r.lower()), r.upper())
+}
+
+// Get 2**k-1 for the least k such that every integer in [0, a] is below 2**k.
+func maskb(a bound) bound {
+	if a.inf != 0 {
+		return a
+	}
+	n := floorRat(a.v).BitLen()
+	if n > maxRangeBits {
+		return infb(1)
+	}
+	m := new(big.Int).Lsh(big.NewInt(1), uint(n))
+	return fin(new(big.Rat).SetInt(m.Sub(m, big.NewInt(1))))
+}
+
+func floorRat(x *big.Rat) *big.Int {
+	return new(big.Int).Div(x.Num(), x.Denom())
+}
+
+func ceilRat(x *big.Rat) *big.Int {
+	q := floorRat(x)
+	if !x.IsInt() {
+		q.Add(q, big.NewInt(1))
+	}
+	return q
+}
+
+// A possible evaluation failure found by Analyze.
+type Warning struct {
+	// The error which evaluation may return: DivByZero or OverflowError.
+	Err error
+	// The span of the operation which may fail.
+	Span Span
+	// Whether the operation fails whenever it is evaluated.
+	Certain bool
+}
+
+func (w Warning) String() string {
+	if w.Certain {
+		return fmt.Sprintf("%v at position %d", w.Err, w.Span.Pos)
+	}
+	return fmt.Sprintf("possible %v at position %d", w.Err, w.Span.Pos)
+}
+
+type analyzer struct {
+	facts    map[string]Range
+	ranges   map[*AST]Range
+	binds    map[*Binding]Range
+	warnings []Warning
+}
+
+// Compute the range of values each node in a tree may take, given ranges of
+// variables; variables without facts may take any value. Operations which may
+// fail with DivByZero or OverflowError are reported in evaluation order.
+func Analyze(root *AST, facts map[string]Range) (map[*AST]Range, []Warning) {
+	a := analyzer{facts: facts, ranges: make(map[*AST]Range), binds: make(map[*Binding]Range)}
+	a.analyze(root)
+	return a.ranges, a.warnings
+}
+
+// Find operations in the expression which may fail. See Analyze.
+func (e *Expr) Lint(facts map[string]Range) []Warning {
+	_, warnings := Analyze(e.AST(), facts)
+	return warnings
+}
+
+// Warn if zero is in r.
+func (a *analyzer) divisor(nn *AST, r Range) {
+	if r.Contains(new(big.Rat)) {
+		a.warnings = append(a.warnings, Warning{DivByZero{}, nn.Span, r.zero()})
+	}
+}
+
+// Warn if r has values of at least lim.
+func (a *analyzer) limit(nn *AST, r Range, lim *big.Int) {
+	l := new(big.Rat).SetInt(lim)
+	if r.upper().cmp(fin(l)) >= 0 {
+		a.warnings = append(a.warnings, Warning{OverflowError{}, nn.Span, r.lower().cmp(fin(l)) >= 0})
+	}
+}
+
+func (a *analyzer) analyze(nn *AST) {
+	for _, child := range nn.Children {
+		a.analyze(child)
+	}
+	var x, y Range
+	if len(nn.Children) > 0 {
+		x = a.ranges[nn.Children[0]]
+	}
+	if len(nn.Children) > 1 {
+		y = a.ranges[nn.Children[1]]
+	}
+	var r Range
+	switch nn.Op {
+	case oNOP:
+		if len(nn.Children) > 0 {
+			r = a.ranges[nn.Children[len(nn.Children)-1]]
+		}
+	case oLOAD:
+		r = a.facts[nn.Val.(string)].norm()
+	case oSTORE:
+		r = x
+		a.binds[nn.Val.(*Binding)] = x
+	case oRECALL:
+		r = a.binds[nn.Val.(*Binding)]
+	case oLET:
+		r = y
+	case oFOR:
+		// The range of a FOR node is that of its index.
+		r = fromBounds(x.lower(), y.upper(), true)
+		a.binds[nn.Val.(*Binding)] = r
+	case oSUM, oPROD:
+		r = Range{Int: y.Int}
+	case oCONST:
+		if c := ratOf(nn.Val); c != nil {
+			r = Exactly(c)
+		}
+	case oADD:
+		r = fromBounds(addb(x.lower(), y.lower()), addb(x.upper(), y.upper()), x.Int && y.Int)
+	case oADDN:
+		r = x
+		for _, child := range nn.Children[1:] {
+			c := a.ranges[child]
+			r = fromBounds(addb(r.lower(), c.lower()), addb(r.upper(), c.upper()), r.Int && c.Int)
+		}
+	case oSUB:
+		r = fromBounds(addb(x.lower(), negb(y.upper())), addb(x.upper(), negb(y.lower())), x.Int && y.Int)
+	case oNEG:
+		r = fromBounds(negb(x.upper()), negb(x.lower()), x.Int)
+	case oABS:
+		switch {
+		case x.lower().sign() >= 0:
+			r = x
+		case x.upper().sign() <= 0:
+			r = fromBounds(negb(x.upper()), negb(x.lower()), x.Int)
+		default:
+			r = fromBounds(fin(new(big.Rat)), absmax(x), x.Int)
+		}
+	case oMUL:
+		lo, hi := mulr(x, y)
+		r = fromBounds(lo, hi, x.Int && y.Int)
+	case oQUO:
+		a.divisor(nn, y)
+		if inv, ok := invr(y); ok {
+			lo, hi := mulr(x, inv)
+			r = fromBounds(lo, hi, false)
+		}
+	case oINV:
+		a.divisor(nn, x)
+		r, _ = invr(x)
+	case oDENOM:
+		r = Range{Lo: big.NewRat(1, 1), Int: true}
+		if x.Int {
+			r.Hi = r.Lo
+		}
+	case oNUM:
+		if x.Int {
+			r = x
+			break
+		}
+		lo, hi := infb(-1), infb(1)
+		if s := x.lower().sign(); s >= 0 {
+			lo = bound{v: new(big.Rat), open: s > 0}
+		}
+		if s := x.upper().sign(); s <= 0 {
+			hi = bound{v: new(big.Rat), open: s < 0}
+		}
+		r = fromBounds(lo, hi, true)
+	case oTRUNC:
+		r = fromBounds(truncb(x.lower()), truncb(x.upper()), true)
+	case oFLOOR:
+		r = fromBounds(floorb(x.lower()), floorb(x.upper()), true)
+	case oCEIL:
+		r = fromBounds(ceilb(x.lower()), ceilb(x.upper()), true)
+	case oMIN, oMAX, oTRY, oDEFAULT:
+		lo, hi := make([]bound, len(nn.Children)), make([]bound, len(nn.Children))
+		isint := true
+		for i, child := range nn.Children {
+			c := a.ranges[child]
+			lo[i], hi[i], isint = c.lower(), c.upper(), isint && c.Int
+		}
+		switch nn.Op {
+		case oMIN:
+			r = fromBounds(minb(lo...), minb(hi...), isint)
+		case oMAX:
+			r = fromBounds(maxb(lo...), maxb(hi...), isint)
+		default:
+			// The result is either operand.
+			r = fromBounds(minb(lo...), maxb(hi...), isint)
+		}
+	case oGCDN:
+		// The gcd divides each operand, so it is at most the largest.
+		hi := make([]bound, len(nn.Children))
+		for i, child := range nn.Children {
+			hi[i] = absmax(a.ranges[child].Integers())
+		}
+		r = fromBounds(fin(new(big.Rat)), maxb(hi...), true)
+	case oLCM:
+		r = Range{Lo: new(big.Rat), Int: true}
+	case oDIVMOD, oEGCD, oCRT:
+		// The range is of the first result.
+		if nn.Op == oDIVMOD {
+			a.divisor(nn, y)
+		}
+		r = Range{Int: true}
+	default:
+		r = a.integer(nn, x.Integers(), y.Integers())
+	}
+	a.ranges[nn] = r
+}
+
+// Analyze an integer-only operation.
+func (a *analyzer) integer(nn *AST, x, y Range) Range {
+	zero, one := new(big.Rat), big.NewRat(1, 1)
+	switch nn.Op {
+	case oNOT:
+		return fromBounds(addb(negb(x.upper()), fin(big.NewRat(-1, 1))), addb(negb(x.lower()), fin(big.NewRat(-1, 1))), true)
+	case oAND:
+		switch {
+		case x.lower().sign() >= 0 && y.lower().sign() >= 0:
+			return fromBounds(fin(zero), minb(x.upper(), y.upper()), true)
+		case x.lower().sign() >= 0:
+			return fromBounds(fin(zero), x.upper(), true)
+		case y.lower().sign() >= 0:
+			return fromBounds(fin(zero), y.upper(), true)
+		}
+	case oANDNOT:
+		if x.lower().sign() >= 0 {
+			return fromBounds(fin(zero), x.upper(), true)
+		}
+	case oOR:
+		if x.lower().sign() >= 0 && y.lower().sign() >= 0 {
+			return fromBounds(maxb(x.lower(), y.lower()), maskb(maxb(x.upper(), y.upper())), true)
+		}
+		if x.upper().sign() < 0 || y.upper().sign() < 0 {
+			return fromBounds(infb(-1), fin(big.NewRat(-1, 1)), true)
+		}
+	case oXOR:
+		if x.lower().sign() >= 0 && y.lower().sign() >= 0 {
+			return fromBounds(fin(zero), maskb(maxb(x.upper(), y.upper())), true)
+		}
+	case oDIV:
+		a.divisor(nn, y)
+		if inv, ok := invr(y); ok {
+			lo, hi := mulr(x, inv)
+			return fromBounds(floorb(lo), ceilb(hi), true)
+		}
+	case oMOD:
+		a.divisor(nn, y)
+		return fromBounds(fin(zero), addb(absmax(y), fin(big.NewRat(-1, 1))), true)
+	case oREM:
+		a.divisor(nn, y)
+		m := addb(absmax(y), fin(big.NewRat(-1, 1)))
+		lo, hi := fin(zero), fin(zero)
+		if x.lower().sign() < 0 {
+			lo = maxb(x.lower(), negb(m))
+		}
+		if x.upper().sign() > 0 {
+			hi = minb(x.upper(), m)
+		}
+		return fromBounds(lo, hi, true)
+	case oGCD:
+		return fromBounds(fin(zero), maxb(absmax(x), absmax(y)), true)
+	case oLSH, oRSH:
+		a.limit(nn, y, uintmax)
+		if y.lower().sign() < 0 {
+			break
+		}
+		if nn.Op == oLSH {
+			lo, hi := mulr(x, fromBounds(pow2b(y.lower()), pow2b(y.upper()), false))
+			return fromBounds(lo, hi, true)
+		}
+		lo, hi := mulr(x, fromBounds(pow2b(negb(y.upper())), pow2b(negb(y.lower())), false))
+		return fromBounds(floorb(lo), floorb(hi), true)
+	case oMULRANGE:
+		a.limit(nn, y, two63)
+		a.limit(nn, x, two63)
+		if x.lower().cmp(fin(one)) >= 0 {
+			return Range{Lo: one, Int: true}
+		}
+	case oBINOMIAL:
+		a.limit(nn, y, two63)
+		a.limit(nn, x, two63)
+		if x.lower().sign() >= 0 && y.lower().sign() >= 0 {
+			return Range{Lo: zero, Int: true}
+		}
+	case oEXP:
+		return a.exp(nn, x, y, a.ranges[nn.Children[2]].Integers())
+	}
+	return Range{Int: true}
+}
+
+func (a *analyzer) exp(nn *AST, x, y, m Range) Range {
+	if y.lower().sign() < 0 {
+		// The modulus is ignored for negative exponents.
+		if x.Contains(new(big.Rat)) {
+			a.warnings = append(a.warnings, Warning{DivByZero{}, nn.Span, x.zero() && y.upper().sign() < 0})
+		}
+		return Range{}
+	}
+	zero := new(big.Rat)
+	if mod := nn.Children[2]; mod.Op != oCONST || mod.Val != nil {
+		if !m.Contains(zero) {
+			return fromBounds(fin(zero), addb(absmax(m), fin(big.NewRat(-1, 1))), true)
+		}
+		return Range{Int: true}
+	}
+	if y.Lo != nil && y.Hi != nil && y.Lo.Cmp(y.Hi) == 0 && y.Lo.Num().IsInt64() && y.Lo.Num().Int64() <= 64 {
+		n := int(y.Lo.Num().Int64())
+		lo, hi := powb(x.lower(), n), powb(x.upper(), n)
+		switch {
+		case n%2 == 1, x.lower().sign() >= 0:
+			return fromBounds(lo, hi, true)
+		case x.upper().sign() <= 0:
+			return fromBounds(hi, lo, true)
+		}
+		return fromBounds(fin(zero), maxb(lo, hi), true)
+	}
+	if s := x.lower().sign(); s >= 0 {
+		return fromBounds(bound{v: zero, open: s > 0}, infb(1), true)
+	}
+	return Range{Int: true}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// The value of an expression, with conversions which report overflow and
+// inexactness instead of truncating.
+type Result struct {
+	r *big.Rat
+}
+
+// Create a Result holding a copy of r.
+func NewResult(r *big.Rat) Result {
+	return Result{new(big.Rat).Set(r)}
+}
+
+// Evaluate an expression as with Eval, returning a Result.
+func (e *Expr) EvalResult(vars map[string]interface{}) (Result, error) {
+	r, err := e.Eval(vars)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{r}, nil
+}
+
+func (r Result) rat() *big.Rat {
+	if r.r == nil {
+		return new(big.Rat)
+	}
+	return r.r
+}
+
+// Check whether the result is an integer.
+func (r Result) IsInt() bool {
+	return r.rat().IsInt()
+}
+
+// Get the result as a *big.Rat, which the caller may modify.
+func (r Result) Rat() *big.Rat {
+	return new(big.Rat).Set(r.rat())
+}
+
+// Get the result as a *big.Int. If it is not an integer, the error is
+// InexactError.
+func (r Result) BigInt() (*big.Int, error) {
+	if !r.IsInt() {
+		return nil, InexactError{r.Rat()}
+	}
+	return new(big.Int).Set(r.rat().Num()), nil
+}
+
+// Get the result as an int64. The error is InexactError if it is not an
+// integer, or OverflowError if it is out of range.
+func (r Result) Int64() (int64, error) {
+	i, err := r.BigInt()
+	if err != nil {
+		return 0, err
+	}
+	if !i.IsInt64() {
+		return 0, OverflowError{}
+	}
+	return i.Int64(), nil
+}
+
+// Get the result as a uint64. The error is InexactError if it is not an
+// integer, or OverflowError if it is out of range.
+func (r Result) Uint64() (uint64, error) {
+	i, err := r.BigInt()
+	if err != nil {
+		return 0, err
+	}
+	if !i.IsUint64() {
+		return 0, OverflowError{}
+	}
+	return i.Uint64(), nil
+}
+
+// Get the float64 nearest the result, and whether it is exact. Results too
+// large in magnitude give an infinity.
+func (r Result) Float64() (float64, bool) {
+	f, exact := r.rat().Float64()
+	return f, exact && !math.IsInf(f, 0)
+}
+
+func (r Result) String() string {
+	return r.rat().RatString()
+}
+
+// Format the result. The verbs v and s give the same as String; d, b, o, x, and
+// X format an integer result as *big.Int does; f and F give the result
+// rounded to the precision, by default 6; and e, E, g, and G format the result
+// as *big.Float does. Other verbs, and integer verbs with fractions, are bad
+// verbs as in package fmt.
+func (r Result) Format(f fmt.State, verb rune) {
+	switch verb {
+	case 'v', 's':
+		fmt.Fprintf(f, directive(f, 's'), r.String())
+	case 'd', 'b', 'o', 'x', 'X':
+		if r.IsInt() {
+			r.rat().Num().Format(f, verb)
+			return
+		}
+		fmt.Fprintf(f, "%%!%c(rpn.Result=%s)", verb, r.String())
+	case 'f', 'F':
+		prec, ok := f.Precision()
+		if !ok {
+			prec = 6
+		}
+		fmt.Fprintf(f, directive(f, 's'), r.rat().FloatString(prec))
+	case 'e', 'E', 'g', 'G':
+		x := r.rat()
+		// Without a precision, give the shortest decimal which identifies the
+		// nearest float64. Otherwise, use enough precision that the digits
+		// are those of x.
+		p := uint(53)
+		if prec, ok := f.Precision(); ok {
+			p = uint(x.Num().BitLen() + x.Denom().BitLen() + 64 + prec*4)
+		}
+		new(big.Float).SetPrec(p).SetRat(x).Format(f, verb)
+	default:
+		fmt.Fprintf(f, "%%!%c(rpn.Result=%s)", verb, r.String())
+	}
+}
+
+// Rebuild a formatting directive with a different verb.
+func directive(f fmt.State, verb rune) string {
+	var buf bytes.Buffer
+	buf.WriteByte('%')
+	for _, c := range "+-# 0" {
+		if f.Flag(int(c)) {
+			buf.WriteRune(c)
+		}
+	}
+	if w, ok := f.Width(); ok {
+		buf.WriteString(strconv.Itoa(w))
+	}
+	buf.WriteRune(verb)
+	return buf.String()
+}
@@ -0,0 +1,311 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"math/big"
+	"strings"
+)
+
+// Limits on the number of rewrites Rewrite may perform, on the number of nodes
+// it may add to the tree, and on the total number of nodes in replacements.
+const (
+	maxRewrites      = 1 << 14
+	maxRewriteGrowth = 1 << 16
+	maxRewriteNodes  = 1 << 20
+)
+
+// A rewrite rule. Rules are written as "pattern -> replacement", optionally
+// followed by "when" and a comma-separated list of conditions, e.g.
+//
+//	x*0 -> 0 when int(x)
+//
+// Every variable in the pattern is a pattern variable which matches any
+// subexpression; a variable appearing more than once must match identical
+// subexpressions each time. Pattern variables in the replacement are
+// replaced by what they matched, and any other variables in the replacement
+// are ordinary variables. The available conditions are:
+//
+//	int(x)     - x always evaluates to an integer
+//	const(x)   - x is a constant
+//	var(x)     - x is a variable
+//	nonzero(x) - x is a nonzero constant
+type Rule struct {
+	// The rule's name, used to report its application. Compiling a rule sets
+	// this to its source.
+	Name string
+
+	pattern, repl *AST
+	conds         []cond
+}
+
+type cond struct {
+	pred, name string
+}
+
+var preds = map[string]func(*AST) bool{
+	"int":     isint,
+	"const":   func(nn *AST) bool { return nn.Op == oCONST && nn.Val != nil },
+	"var":     func(nn *AST) bool { return nn.Op == oLOAD },
+	"nonzero": func(nn *AST) bool { return nn.Op == oCONST && nn.Val != nil && !eqzero(nn.Val) },
+}
+
+// Compile a rewrite rule with pattern and replacement in Go syntax.
+func CompileRuleGo(rule string) (*Rule, error) {
+	return compileRule(rule, CompileGo)
+}
+
+// Compile a rewrite rule with pattern and replacement in RPN syntax.
+func CompileRuleRPN(rule string) (*Rule, error) {
+	return compileRule(rule, CompileRPN)
+}
+
+func compileRule(rule string, compile func(string) (*Expr, error)) (*Rule, error) {
+	i := strings.Index(rule, "->")
+	if i < 0 {
+		return nil, BadRule{rule, "missing ->"}
+	}
+	pat, repl := rule[:i], rule[i+2:]
+	var conds string
+	if j := strings.Index(repl, " when "); j >= 0 {
+		repl, conds = repl[:j], repl[j+6:]
+	}
+	r := &Rule{Name: strings.TrimSpace(rule)}
+	pe, err := compile(pat)
+	if err != nil {
+		return nil, BadRule{rule, "pattern: " + err.Error()}
+	}
+	re, err := compile(repl)
+	if err != nil {
+		return nil, BadRule{rule, "replacement: " + err.Error()}
+	}
+	pa, ra := pe.AST(), re.AST()
+	if len(pa.Children) != 1 || len(ra.Children) != 1 || results(pa.Children[0].Op) > 1 || results(ra.Children[0].Op) > 1 {
+		return nil, BadRule{rule, "multiple values"}
+	}
+	r.pattern, r.repl = pa.Children[0], ra.Children[0]
+	if r.pattern.Op == oLOAD {
+		return nil, BadRule{rule, "pattern matches everything"}
+	}
+	bound := make(map[string]bool)
+	for _, name := range pe.names {
+		bound[name] = true
+	}
+	for _, c := range strings.Split(conds, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		i := strings.Index(c, "(")
+		if i < 0 || !strings.HasSuffix(c, ")") {
+			return nil, BadRule{rule, "bad condition " + c}
+		}
+		p, name := c[:i], strings.TrimSpace(c[i+1:len(c)-1])
+		if preds[p] == nil {
+			return nil, BadRule{rule, "unknown condition " + p}
+		}
+		if !bound[name] {
+			return nil, BadRule{rule, "condition on unbound " + name}
+		}
+		r.conds = append(r.conds, cond{p, name})
+	}
+	return r, nil
+}
+
+// Create a new expression by applying rewrite rules until none applies. Rules
+// are tried in order at each node, from the leaves upward, and constants are
+// folded after each pass. If the rules do not reach a fixed point, the error is
+// RewriteLoop, which is also the error if they make too many rewrites or grow
+// the expression too large.
+func (e *Expr) Rewrite(rules ...*Rule) (*Expr, error) {
+	ast := e.AST()
+	foldConsts(ast)
+	seen := map[string]bool{ast.expr().String(): true}
+	w := rewriter{rules: rules}
+	for {
+		changed := false
+		for _, nn := range ast.Children {
+			if w.rewrite(nn) {
+				changed = true
+			}
+		}
+		if w.exceeded() {
+			return nil, RewriteLoop{}
+		}
+		if !changed {
+			break
+		}
+		foldConsts(ast)
+		s := ast.expr().String()
+		if seen[s] {
+			return nil, RewriteLoop{}
+		}
+		seen[s] = true
+	}
+	return ast.expr(), nil
+}
+
+// State of a Rewrite: the rules, the number of rewrites made, the number of
+// nodes by which the tree has grown, and the number of nodes built.
+type rewriter struct {
+	rules           []*Rule
+	n, grown, built int
+}
+
+// Check whether a Rewrite has gone on too long.
+func (w *rewriter) exceeded() bool {
+	return w.n > maxRewrites || w.grown > maxRewriteGrowth || w.built > maxRewriteNodes
+}
+
+// Make one pass of rewrites, stopping as soon as the limits are exceeded.
+func (w *rewriter) rewrite(nn *AST) (changed bool) {
+	for _, child := range nn.Children {
+		if w.exceeded() {
+			return changed
+		}
+		if w.rewrite(child) {
+			changed = true
+		}
+	}
+	if w.exceeded() {
+		return changed
+	}
+	for _, r := range w.rules {
+		if nw := r.apply(nn); nw != nil {
+			replace(nn, nw)
+			k := treeSize(nw)
+			w.n++
+			w.grown += k - treeSize(nn)
+			w.built += k
+			return true
+		}
+	}
+	return changed
+}
+
+// Count the nodes in a tree.
+func treeSize(nn *AST) int {
+	n := 1
+	for _, child := range nn.Children {
+		n += treeSize(child)
+	}
+	return n
+}
+
+// Try to apply the rule to a node, returning the replacement on success.
+func (r *Rule) apply(nn *AST) *AST {
+	binds := make(map[string]*AST)
+	if !match(r.pattern, nn, binds) {
+		return nil
+	}
+	for _, c := range r.conds {
+		if !preds[c.pred](binds[c.name]) {
+			return nil
+		}
+	}
+	return instantiate(r.repl, binds)
+}
+
+func match(pat, nn *AST, binds map[string]*AST) bool {
+	switch pat.Op {
+	case oLOAD:
+		name := pat.Val.(string)
+		if b, ok := binds[name]; ok {
+			return equalAST(b, nn)
+		}
+		binds[name] = nn
+		return true
+	case oCONST:
+		return nn.Op == oCONST && equalVal(pat.Val, nn.Val)
+	}
+	if pat.Op != nn.Op || len(pat.Children) != len(nn.Children) {
+		return false
+	}
+	for i, child := range pat.Children {
+		if !match(child, nn.Children[i], binds) {
+			return false
+		}
+	}
+	return true
+}
+
+func instantiate(repl *AST, binds map[string]*AST) *AST {
+	if repl.Op == oLOAD {
+		if b, ok := binds[repl.Val.(string)]; ok {
+			return b.clone()
+		}
+	}
+	if len(repl.Children) == 0 {
+		return repl.clone()
+	}
+	children := make([]*AST, len(repl.Children))
+	for i, child := range repl.Children {
+		children[i] = instantiate(child, binds)
+	}
+	return newAST(repl.Op, repl.Val, children...)
+}
+
+// Put nw in the place of nn.
+func replace(nn, nw *AST) {
+	nw.Parent = nn.Parent
+	if nn.Parent != nil {
+		nn.Parent.Children[findme(nn)] = nw
+		nn.Parent = nil
+	}
+}
+
+// Determine whether two subtrees are structurally identical.
+func equalAST(a, b *AST) bool {
+	if a.Op != b.Op || len(a.Children) != len(b.Children) || !equalVal(a.Val, b.Val) {
+		return false
+	}
+	for i, child := range a.Children {
+		if !equalAST(child, b.Children[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalVal(a, b interface{}) bool {
+	switch x := a.(type) {
+	case *big.Int:
+		y, ok := b.(*big.Int)
+		return ok && x.Cmp(y) == 0
+	case *big.Rat:
+		y, ok := b.(*big.Rat)
+		return ok && x.Cmp(y) == 0
+	}
+	return a == b
+}
+
+func eqzero(val interface{}) bool {
+	switch a := val.(type) {
+	case *big.Int:
+		return a.Sign() == 0
+	case *big.Rat:
+		return a.Sign() == 0
+	}
+	return false
+}
@@ -25,6 +25,8 @@ package rpn
 
 import (
 	"math/big"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -36,63 +38,615 @@ import (
 // correctly compile the output of an expression's String() method, and allows
 // alternate representations of some things. See
 // https://github.com/zephyrtronium/rpn/wiki/RPN-Syntax for more information.
+//
+// A word =name pops a value and binds it to name. The binding is in scope
+// until the first value pushed after it, its body, is consumed by an operation
+// which also consumes values from before it, or until the end of the
+// expression; the body is the result. Within the scope, name without
+// parentheses recalls the bound value, while (name) is always a variable.
+// Bindings may not shadow enclosing bindings of the same name.
+//
+// A word FOR:i pops an upper and then a lower bound and binds i to each
+// integer between them in turn; the next value pushed is the body, and a SUM
+// or PROD after it gives the sum or product of its values.
+//
+// TRY x ELSE y END gives the value of y if computing x fails with any error
+// but a missing variable, and DEFAULT x ELSE y END if it fails with a missing
+// variable. Operations in x and y may not consume values from before them.
+//
+// DUP, DROP, SWAP, OVER, and ROT rearrange the values on top of the stack as in
+// Forth when the expression is compiled; a value used more than once is
+// computed once and stored. : name ... ; defines a word which stands for the
+// words between name and ;, and # or ( followed by a space begins a comment,
+// which runs to the end of the line or to ) respectively. Uses of words may
+// expand to at most DefaultMaxOps words in all.
+//
+// Each value left on the stack is a result of the expression. The results of
+// DIVMOD, EGCD, and CRT can only be results of the expression, not operands.
 func CompileRPN(expr string) (*Expr, error) {
+	return compileRPN(expr, nil)
+}
+
+func compileRPN(expr string, funcs *Funcs) (*Expr, error) {
 	e := new(Expr)
-	l := lexer{strings.TrimSpace(expr), 0}
+	stack, err := rpnCompile(e, expr, nil, env{funcs: funcs})
+	if err != nil {
+		return nil, err
+	}
+	if stack == 0 {
+		return nil, EmptyStack{}
+	}
+	if _, err := e.Type(nil); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Compile an expression onto the end of e, with the given bindings in scope,
+// giving the number of values it leaves on the stack.
+func rpnCompile(e *Expr, expr string, scopes []scope, en env) (int, error) {
+	src := strings.TrimSpace(expr)
+	l := lexer{src: src, pos: strings.Index(expr, src)}
+	// Where the ops computing each value on the stack begin.
+	var marks []mark
+	push := func() {
+		marks = append(marks, mark{len(e.ops), len(e.slots)})
+	}
 	stack := 0
+	// Values below sealed are results of an operation with several results,
+	// which later operations may not consume.
+	sealed, sealer := 0, ""
+	// TRY and DEFAULT blocks being compiled, innermost last.
+	var blocks []block
+	single := func(n int, word string) error {
+		if stack-n < sealed {
+			return MultiValue{sealer, l.pos}
+		}
+		if len(blocks) > 0 && stack-n < blocks[len(blocks)-1].start {
+			return StackError{word, l.pos}
+		}
+		return nil
+	}
 	for {
 		t, err := l.next()
 		switch t.kind {
 		case tBAD:
-			return nil, err
+			return 0, err
 		case tLIT:
-			e.ops = append(e.ops, oCONST)
+			push()
+			e.emit(oCONST, l.span())
 			v, _ := new(big.Rat).SetString(t.val)
 			e.consts = append(e.consts, v)
 			stack++
 		case tOP:
-			op := ops[t.val]
+			op, n, variadic := variadicOp(t.val)
+			if !variadic {
+				op, n = ops[t.val], 2
+			}
 			switch op {
-			case oNOP: // do nothing
+			case oNOP:
+				n = 0
 			case oABS, oNEG, oNOT, oDENOM, oINV, oNUM, oTRUNC, oFLOOR, oCEIL:
-				if stack < 1 {
-					return nil, StackError{t.val, l.pos}
-				}
+				n = 1
 			case oEXP:
-				stack -= 2
-				if stack < 1 {
-					return nil, StackError{t.val, l.pos}
+				n = 3
+			case oSUM, oPROD:
+				if err := single(1, t.val); err != nil {
+					return 0, err
+				}
+				// The loop must be in the innermost block.
+				base := 0
+				if len(blocks) > 0 {
+					base = blocks[len(blocks)-1].scopes
+				}
+				inner, err := closeLoop(e, scopes[base:], marks, t.val, stack, l.pos)
+				if err != nil {
+					return 0, err
+				}
+				scopes = scopes[:base+len(inner)]
+				e.emit(op, l.span())
+				continue
+			case oTRY, oDEFAULT:
+				blocks = append(blocks, block{t.val, stack, mark{len(e.ops), len(e.slots)}, len(scopes), false})
+				e.emit(op, l.span())
+				continue
+			case oELSE, oEND:
+				if len(blocks) == 0 || blocks[len(blocks)-1].inElse != (op == oEND) {
+					return 0, BlockError{t.val, l.pos}
+				}
+				b := &blocks[len(blocks)-1]
+				if stack != b.start+1 {
+					return 0, BlockError{t.val, l.pos}
 				}
-			default:
-				// binary operator
-				stack--
-				if stack < 1 {
-					return nil, StackError{t.val, l.pos}
+				if err := single(1, t.val); err != nil {
+					return 0, err
 				}
+				// Close the bindings made in the block, but not those it is in.
+				inner, err := closeScopes(e, scopes[b.scopes:], marks, b.start-1, stack, l.pos)
+				if err != nil {
+					return 0, err
+				}
+				scopes = scopes[:b.scopes+len(inner)]
+				e.emit(op, l.span())
+				marks = marks[:b.start]
+				if op == oELSE {
+					b.inElse = true
+					stack--
+				} else {
+					marks = append(marks, b.at)
+					blocks = blocks[:len(blocks)-1]
+				}
+				continue
+			}
+			if stack < n {
+				return 0, StackError{t.val, l.pos}
+			}
+			if op == oCRT && n%2 != 0 {
+				return 0, BadRPNToken{t.val, l.pos}
+			}
+			if err := single(n, t.val); err != nil {
+				return 0, err
+			}
+			if scopes, err = closeScopes(e, scopes, marks, stack-n, stack, l.pos); err != nil {
+				return 0, err
+			}
+			if n > 0 {
+				stack -= n - 1
+				marks = marks[:stack]
+			}
+			e.emit(op, l.span())
+			if variadic {
+				e.counts = append(e.counts, n)
+			}
+			if k := results(op); k > 1 {
+				for i := 1; i < k; i++ {
+					marks = append(marks, marks[stack-1])
+				}
+				stack += k - 1
+				sealed, sealer = stack, t.val
+			}
+		case tIDENT, tNAME:
+			if b := lookupScope(scopes, t.val); b != nil && t.kind == tNAME {
+				push()
+				e.emit(oRECALL, l.span())
+				e.slots = append(e.slots, e.slot(b))
+			} else if ok, err := l.expand(t); err != nil {
+				return 0, err
+			} else if ok {
+				continue
+			} else if f := en.funcs.get(t.val); f != nil && t.kind == tNAME {
+				n := len(f.params)
+				if stack < n {
+					return 0, StackError{t.val, l.pos}
+				}
+				if err := single(n, t.val); err != nil {
+					return 0, err
+				}
+				if scopes, err = closeScopes(e, scopes, marks, stack-n, stack, l.pos); err != nil {
+					return 0, err
+				}
+				if n == 0 {
+					push()
+				}
+				params := f.bindings()
+				// Store each argument just after the ops which compute it.
+				for i := n - 1; i >= 0; i-- {
+					at := mark{len(e.ops), len(e.slots)}
+					if i < n-1 {
+						at = marks[stack-n+i+1]
+					}
+					e.insert(at, oSTORE, l.span(), e.slot(params[i]))
+				}
+				if err := en.funcs.call(e, f, params, en, l.span()); err != nil {
+					return 0, err
+				}
+				// The result replaces the arguments.
+				stack -= n
+				marks = marks[:stack+1]
+			} else {
+				push()
+				e.emit(oLOAD, l.span())
+				e.names = append(e.names, t.val)
 			}
-			e.ops = append(e.ops, op)
-		case tIDENT:
-			e.ops = append(e.ops, oLOAD)
-			e.names = append(e.names, t.val)
 			stack++
+		case tSTORE:
+			if stack < 1 {
+				return 0, StackError{"=" + t.val, l.pos}
+			}
+			if err := single(1, t.val); err != nil {
+				return 0, err
+			}
+			if scopes, err = closeScopes(e, scopes, marks, stack-1, stack, l.pos); err != nil {
+				return 0, err
+			}
+			if lookupScope(scopes, t.val) != nil {
+				return 0, ScopeError{t.val, "shadows an enclosing binding", l.pos}
+			}
+			b := &Binding{t.val}
+			e.emit(oSTORE, l.span())
+			e.slots = append(e.slots, e.slot(b))
+			scopes = append(scopes, scope{b, stack, marks[stack-1], false, false})
+			stack--
+			marks = marks[:stack]
+		case tFOR:
+			if stack < 2 {
+				return 0, StackError{"FOR:" + t.val, l.pos}
+			}
+			if err := single(2, t.val); err != nil {
+				return 0, err
+			}
+			if scopes, err = closeScopes(e, scopes, marks, stack-2, stack, l.pos); err != nil {
+				return 0, err
+			}
+			if lookupScope(scopes, t.val) != nil {
+				return 0, ScopeError{t.val, "shadows an enclosing binding", l.pos}
+			}
+			b := &Binding{t.val}
+			e.emit(oFOR, l.span())
+			e.slots = append(e.slots, e.slot(b))
+			scopes = append(scopes, scope{b, stack - 1, marks[stack-2], true, false})
+			stack -= 2
+			marks = marks[:stack]
+		case tSTACK:
+			w := stackWords[t.val]
+			if stack < w.n {
+				return 0, StackError{t.val, l.pos}
+			}
+			if err := single(w.n, t.val); err != nil {
+				return 0, err
+			}
+			if scopes, err = closeScopes(e, scopes, marks, stack-w.n, stack, l.pos); err != nil {
+				return 0, err
+			}
+			low := stack - w.n
+			m, copies := e.arrange(marks[low:], w.order, low+1, l.span())
+			scopes = append(scopes, copies...)
+			stack += len(w.order) - w.n
+			marks = append(marks[:low], m...)
+			scopes = dropScopes(e, scopes, stack)
+		case tDEF:
+			if err := l.define(); err != nil {
+				return 0, err
+			}
+		case tENDDEF:
+			return 0, BlockError{t.val, l.pos}
 		case tNIL:
-			e.ops = append(e.ops, oCONST)
+			push()
+			e.emit(oCONST, l.span())
 			e.consts = append(e.consts, nil)
 			stack++
 		case tEND:
-			if stack > 1 {
-				return e, LargeStack{}
+			if len(blocks) > 0 {
+				return 0, BlockError{blocks[len(blocks)-1].word, l.pos}
+			}
+			if scopes, err = closeScopes(e, scopes, marks, -1, stack, l.pos); err != nil {
+				return 0, err
 			}
-			return e, nil
+			return stack, nil
 		}
 	}
 }
 
+// A position in the op and slot streams of an expression.
+type mark struct {
+	op, slot int
+}
+
+// Rearrange the values at the end of an expression, which begin at the given
+// marks, into the given order, giving the marks at which they then begin. A
+// value used more than once is stored before the others and recalled in each
+// place, giving a scope for its binding with the given depth.
+func (e *Expr) arrange(starts []mark, order []int, depth int, span Span) ([]mark, []scope) {
+	vals := make([]*Expr, len(starts))
+	for i := len(starts) - 1; i >= 0; i-- {
+		vals[i] = e.split(starts[i])
+	}
+	uses := make([]int, len(vals))
+	for _, i := range order {
+		uses[i]++
+	}
+	var scopes []scope
+	binds := make([]*Binding, len(vals))
+	for i, v := range vals {
+		if uses[i] > 1 {
+			at := mark{len(e.ops), len(e.slots)}
+			e.join(v, nil)
+			binds[i] = new(Binding)
+			e.emit(oSTORE, span)
+			e.slots = append(e.slots, e.slot(binds[i]))
+			scopes = append(scopes, scope{binds[i], depth, at, false, true})
+		}
+	}
+	marks := make([]mark, len(order))
+	for k, i := range order {
+		marks[k] = mark{len(e.ops), len(e.slots)}
+		if binds[i] != nil {
+			e.emit(oRECALL, span)
+			e.slots = append(e.slots, e.slot(binds[i]))
+		} else {
+			e.join(vals[i], nil)
+		}
+	}
+	return marks, scopes
+}
+
+// Remove the ops from a mark to the end of an expression, giving them as an
+// expression which uses the same slots.
+func (e *Expr) split(at mark) *Expr {
+	nn, nc, na := len(e.names), len(e.consts), len(e.counts)
+	for _, op := range e.ops[at.op:] {
+		switch op {
+		case oLOAD:
+			nn--
+		case oCONST:
+			nc--
+		case oADDN, oMIN, oMAX, oGCDN, oLCM, oCRT:
+			na--
+		}
+	}
+	v := &Expr{
+		ops:    append([]operator(nil), e.ops[at.op:]...),
+		names:  append([]string(nil), e.names[nn:]...),
+		consts: append([]*big.Rat(nil), e.consts[nc:]...),
+		spans:  append([]Span(nil), e.spans[at.op:]...),
+		slots:  append([]int(nil), e.slots[at.slot:]...),
+		counts: append([]int(nil), e.counts[na:]...),
+	}
+	e.ops, e.names, e.consts, e.spans = e.ops[:at.op], e.names[:nn], e.consts[:nc], e.spans[:at.op]
+	e.slots, e.counts = e.slots[:at.slot], e.counts[:na]
+	return v
+}
+
+// Append an expression split from e. If renamed is not nil, the values it
+// stores are given new bindings, recorded in renamed by slot.
+func (e *Expr) join(v *Expr, renamed map[int]int) {
+	e.ops = append(e.ops, v.ops...)
+	e.names = append(e.names, v.names...)
+	e.consts = append(e.consts, v.consts...)
+	e.spans = append(e.spans, v.spans...)
+	e.counts = append(e.counts, v.counts...)
+	slots := v.slots
+	for _, op := range v.ops {
+		switch op {
+		case oSTORE, oFOR, oRECALL:
+			k := slots[0]
+			slots = slots[1:]
+			if renamed != nil && op != oRECALL {
+				renamed[k] = e.slot(&Binding{e.binds[k].Name})
+			}
+			if r, ok := renamed[k]; ok {
+				k = r
+			}
+			e.slots = append(e.slots, k)
+		}
+	}
+}
+
+// Check whether an expression split from another recalls the value in a slot.
+func (v *Expr) recalls(slot int) bool {
+	slots := v.slots
+	for _, op := range v.ops {
+		switch op {
+		case oSTORE, oFOR, oRECALL:
+			if op == oRECALL && slots[0] == slot {
+				return true
+			}
+			slots = slots[1:]
+		}
+	}
+	return false
+}
+
+// Insert an op which uses a slot at a position in an expression.
+func (e *Expr) insert(at mark, op operator, span Span, slot int) {
+	e.ops = append(e.ops[:at.op], append([]operator{op}, e.ops[at.op:]...)...)
+	e.spans = append(e.spans[:at.op], append([]Span{span}, e.spans[at.op:]...)...)
+	e.slots = append(e.slots[:at.slot], append([]int{slot}, e.slots[at.slot:]...)...)
+}
+
+// A TRY or DEFAULT being compiled, with the word beginning it, the stack
+// position below its value, where its ops begin, the number of bindings in
+// scope before it, and whether its ELSE has been compiled.
+type block struct {
+	word   string
+	start  int
+	at     mark
+	scopes int
+	inElse bool
+}
+
+// A binding in scope, with the stack position of its body and where the ops
+// computing its value begin. The scope of a loop index is closed only by SUM
+// or PROD. A binding made by a stack word to copy a value may have several
+// values in its body.
+type scope struct {
+	b     *Binding
+	depth int
+	start mark
+	loop  bool
+	copy  bool
+}
+
+// Close the scopes of bindings whose bodies an operation is about to consume
+// along with values from before them, where low is the stack position just
+// below the operation's operands.
+func closeScopes(e *Expr, scopes []scope, marks []mark, low, stack, pos int) ([]scope, error) {
+	for len(scopes) > 0 && scopes[len(scopes)-1].depth > low+1 {
+		s := scopes[len(scopes)-1]
+		if s.loop {
+			return nil, ScopeError{s.b.Name, "is not closed by SUM or PROD", pos}
+		}
+		if s.copy && stack > s.depth {
+			return widenScopes(e, scopes, marks, low, stack, pos)
+		}
+		if err := s.check(stack, pos); err != nil {
+			return nil, err
+		}
+		e.emit(oLET, Span{})
+		// The value of the LET begins with that of the binding.
+		marks[s.depth-1] = s.start
+		scopes = scopes[:len(scopes)-1]
+	}
+	return scopes, nil
+}
+
+// Extend the scopes of copied values whose copies are in several values, some
+// of which an operation is about to consume along with values from before
+// them, to cover those values as well. If the values are results of the
+// expression, where low is -1, each instead gets its own copy of the stored
+// values.
+func widenScopes(e *Expr, scopes []scope, marks []mark, low, stack, pos int) ([]scope, error) {
+	j := len(scopes)
+	for j > 0 && scopes[j-1].depth > low+1 {
+		j--
+		switch s := scopes[j]; {
+		case s.loop:
+			return nil, ScopeError{s.b.Name, "is not closed by SUM or PROD", pos}
+		case !s.copy:
+			return nil, s.check(stack, pos)
+		}
+	}
+	wide := scopes[j:]
+	top := wide[0].depth - 1
+	if low >= 0 {
+		top = low
+	}
+	// Cut the ops into the values from top and the ops storing each copied
+	// value, which come before the values in its body.
+	cuts := make([]mark, 0, len(wide)+stack-top)
+	for _, s := range wide {
+		cuts = append(cuts, s.start)
+	}
+	cuts = append(cuts, marks[top:stack]...)
+	sort.Slice(cuts, func(i, k int) bool { return cuts[i].op < cuts[k].op })
+	parts := make(map[mark]*Expr, len(cuts))
+	for i := len(cuts) - 1; i >= 0; i-- {
+		parts[cuts[i]] = e.split(cuts[i])
+	}
+	stores := make([]*Expr, len(wide))
+	for i, s := range wide {
+		stores[i] = parts[s.start]
+	}
+	vals := make([]*Expr, stack-top)
+	for k := range vals {
+		vals[k] = parts[marks[top+k]]
+	}
+	if low >= 0 {
+		// Store the copied values before the values they are now in scope of.
+		for i := range wide {
+			wide[i].start, wide[i].depth = mark{len(e.ops), len(e.slots)}, low+1
+			e.join(stores[i], nil)
+		}
+		for k, v := range vals {
+			marks[top+k] = mark{len(e.ops), len(e.slots)}
+			e.join(v, nil)
+		}
+		return scopes, nil
+	}
+	for k, v := range vals {
+		marks[top+k] = mark{len(e.ops), len(e.slots)}
+		var renamed map[int]int
+		if k > 0 {
+			renamed = make(map[int]int)
+		}
+		// Only the stored values which the result recalls, directly or
+		// through those after them, are copied.
+		need := make([]bool, len(wide))
+		for i := len(wide) - 1; i >= 0; i-- {
+			if wide[i].depth-1 > top+k {
+				continue
+			}
+			slot := e.slot(wide[i].b)
+			need[i] = v.recalls(slot)
+			for m := i + 1; m < len(wide) && !need[i]; m++ {
+				need[i] = need[m] && stores[m].recalls(slot)
+			}
+		}
+		n := 0
+		for i := range wide {
+			if need[i] {
+				e.join(stores[i], renamed)
+				n++
+			}
+		}
+		e.join(v, renamed)
+		for ; n > 0; n-- {
+			e.emit(oLET, Span{})
+		}
+	}
+	return scopes[:j], nil
+}
+
+// Remove the scopes of copied values whose copies have all been dropped, along
+// with the ops storing them.
+func dropScopes(e *Expr, scopes []scope, stack int) []scope {
+	for len(scopes) > 0 {
+		s := scopes[len(scopes)-1]
+		if !s.copy || s.depth <= stack {
+			break
+		}
+		e.split(s.start)
+		scopes = scopes[:len(scopes)-1]
+	}
+	return scopes
+}
+
+// Close the scope of the innermost loop index and of all bindings within it
+// for a SUM or PROD.
+func closeLoop(e *Expr, scopes []scope, marks []mark, word string, stack, pos int) ([]scope, error) {
+	i := len(scopes) - 1
+	for i >= 0 && !scopes[i].loop {
+		i--
+	}
+	if i < 0 {
+		return nil, StackError{word, pos}
+	}
+	// The body must be one value before the scopes within it are closed.
+	s := scopes[i]
+	if err := s.check(stack, pos); err != nil {
+		return nil, err
+	}
+	if _, err := closeScopes(e, scopes[i+1:], marks, -1, stack, pos); err != nil {
+		return nil, err
+	}
+	marks[s.depth-1] = s.start
+	return scopes[:i], nil
+}
+
+// Check that the body of a binding is the single value at the top of the
+// stack.
+func (s scope) check(stack, pos int) error {
+	switch {
+	case stack < s.depth:
+		return ScopeError{s.b.Name, "has no body", pos}
+	case stack > s.depth:
+		return ScopeError{s.b.Name, "has more than one value in its body", pos}
+	}
+	return nil
+}
+
+// Find the innermost binding of a name.
+func lookupScope(scopes []scope, name string) *Binding {
+	for i := len(scopes) - 1; i >= 0; i-- {
+		if scopes[i].b.Name == name {
+			return scopes[i].b
+		}
+	}
+	return nil
+}
+
 // lexer
 
 type lexer struct {
-	src string
-	pos int
+	src             string
+	pos, start, end int
+	// Bodies of words defined with : and ;.
+	words map[string][]tok
+	// Tokens of a word being expanded, and whether the last token was one.
+	queue  []tok
+	queued bool
+	// Number of tokens queued from words so far.
+	expanded int
 }
 
 type tok struct {
@@ -104,9 +658,15 @@ const (
 	tBAD = iota
 	tLIT
 	tOP
-	tIDENT
+	tIDENT // parenthesized name
+	tNAME  // bare name
+	tSTORE
+	tFOR
 	tNIL
 	tEND
+	tSTACK // stack manipulation word
+	tDEF   // :
+	tENDDEF
 )
 
 var ops = map[string]operator{
@@ -149,39 +709,217 @@ var ops = map[string]operator{
 	"TRUNC":    oTRUNC,
 	"FLOOR":    oFLOOR,
 	"CEIL":     oCEIL,
+	"SUM":      oSUM,
+	"PROD":     oPROD,
+	"DIVMOD":   oDIVMOD,
+	"EGCD":     oEGCD,
+	"TRY":      oTRY,
+	"DEFAULT":  oDEFAULT,
+	"ELSE":     oELSE,
+	"END":      oEND,
+}
+
+// Words which rearrange the values on top of the stack, with the number of
+// values each takes and the order in which it leaves them, by index from the
+// lowest.
+var stackWords = map[string]struct {
+	n     int
+	order []int
+}{
+	"DUP":  {1, []int{0, 0}},
+	"DROP": {1, nil},
+	"SWAP": {2, []int{1, 0}},
+	"OVER": {2, []int{0, 1, 0}},
+	"ROT":  {3, []int{1, 2, 0}},
+}
+
+// Names of variadic operations. A count of operands follows the name, as in
+// MIN/3; without one, the operation takes two.
+var variadics = map[operator]string{
+	oADDN: "ADD",
+	oMIN:  "MIN",
+	oMAX:  "MAX",
+	oGCDN: "GCD",
+	oLCM:  "LCM",
+	oCRT:  "CRT",
+}
+
+// Get the operation and count of operands of a variadic operation word.
+func variadicOp(s string) (operator, int, bool) {
+	name, count := s, "2"
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		name, count = s[:i], s[i+1:]
+	} else if strings.EqualFold(name, "GCD") || strings.EqualFold(name, "ADD") {
+		// GCD and ADD alone are the binary operations.
+		return oNOP, 0, false
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 || count[0] == '+' {
+		return oNOP, 0, false
+	}
+	for op, v := range variadics {
+		if v == strings.ToUpper(name) {
+			return op, n, true
+		}
+	}
+	return oNOP, 0, false
 }
 
 func (l *lexer) next() (tok, error) {
+	if len(l.queue) > 0 {
+		// Tokens from a word keep the span of its use.
+		t := l.queue[0]
+		l.queue, l.queued = l.queue[1:], true
+		return t, nil
+	}
+	l.queued = false
+	for len(l.src) > 0 {
+		if l.src[0] == '#' {
+			// A comment runs to the end of the line.
+			off := strings.IndexByte(l.src, '\n')
+			if off < 0 {
+				off = len(l.src)
+			}
+			l.skip(off)
+			continue
+		}
+		if r, _ := utf8.DecodeRuneInString(l.src[1:]); l.src[0] == '(' && (len(l.src) == 1 || unicode.IsSpace(r)) {
+			// So does one from ( to ), while (name) is a variable.
+			off := strings.IndexByte(l.src, ')')
+			if off < 0 {
+				return tok{tBAD, "("}, BlockError{"(", l.pos}
+			}
+			l.skip(off + 1)
+			continue
+		}
+		break
+	}
 	if len(l.src) == 0 {
 		return tok{tEND, ""}, nil
 	}
+	l.start = l.pos
 	off := strings.IndexFunc(l.src, unicode.IsSpace)
 	if off < 0 {
 		// end of string
+		l.end = l.pos + len(l.src)
 		t, err := l.lexWord(l.src)
 		l.src = ""
 		return t, err
 	}
 	s := l.src[:off]
-	l.src = l.src[off+1:]
-	l.pos += off + 1
-	off = strings.IndexFunc(l.src, func(r rune) bool { return !unicode.IsSpace(r) })
+	l.end = l.pos + off
+	l.skip(off)
+	return l.lexWord(s)
+}
+
+// Move past n bytes of the source and the space after them.
+func (l *lexer) skip(n int) {
+	l.src = l.src[n:]
+	l.pos += n
+	off := strings.IndexFunc(l.src, func(r rune) bool { return !unicode.IsSpace(r) })
 	if off < 0 {
+		l.pos += len(l.src)
 		l.src = ""
 	} else {
 		l.src = l.src[off:]
 		l.pos += off
 	}
-	return l.lexWord(s)
+}
+
+// Read the definition of a word after a :, up to the ; ending it. Words in the
+// body which are already defined are expanded now, so a word cannot use
+// itself.
+func (l *lexer) define() error {
+	name, err := l.next()
+	switch {
+	case err != nil:
+		return err
+	case name.kind == tEND:
+		return BlockError{":", l.pos}
+	case name.kind != tNAME:
+		return BadRPNToken{name.val, l.pos}
+	}
+	var body []tok
+	for {
+		t, err := l.next()
+		if err != nil {
+			return err
+		}
+		switch t.kind {
+		case tENDDEF:
+			if l.words == nil {
+				l.words = make(map[string][]tok)
+			}
+			l.words[name.val] = body
+			return nil
+		case tDEF, tEND:
+			return BlockError{":", l.pos}
+		case tNAME:
+			if w, ok := l.words[t.val]; ok {
+				// Each word may double the size of the next, so check the
+				// body as it grows.
+				if len(body)+len(w) > DefaultMaxOps {
+					return WordSizeError{name.val, l.pos}
+				}
+				body = append(body, w...)
+				continue
+			}
+		}
+		body = append(body, t)
+	}
+}
+
+// Expand a word defined with : if the last token read is its name, giving
+// whether it was.
+func (l *lexer) expand(t tok) (bool, error) {
+	w, ok := l.words[t.val]
+	if !ok || l.queued || t.kind != tNAME {
+		return false, nil
+	}
+	if l.expanded += len(w); l.expanded > DefaultMaxOps {
+		return false, WordSizeError{t.val, l.pos}
+	}
+	l.queue = append(l.queue, w...)
+	return true, nil
+}
+
+// Get the span of the last token lexed.
+func (l *lexer) span() Span {
+	return Span{l.start, l.end}
 }
 
 func (l *lexer) lexWord(s string) (tok, error) {
 	if _, ok := ops[strings.ToUpper(s)]; ok {
 		return tok{tOP, strings.ToUpper(s)}, nil
 	}
+	if _, ok := stackWords[strings.ToUpper(s)]; ok {
+		return tok{tSTACK, strings.ToUpper(s)}, nil
+	}
+	switch s {
+	case ":":
+		return tok{tDEF, s}, nil
+	case ";":
+		return tok{tENDDEF, s}, nil
+	}
+	if _, _, ok := variadicOp(s); ok {
+		return tok{tOP, strings.ToUpper(s)}, nil
+	}
 	if nam, ok := lexIdent(s); ok {
+		if nam == s {
+			return tok{tNAME, nam}, nil
+		}
 		return tok{tIDENT, nam}, nil
 	}
+	if strings.HasPrefix(s, "=") {
+		if nam, ok := lexIdent(s[1:]); ok && nam == s[1:] && !reserved(nam) {
+			return tok{tSTORE, nam}, nil
+		}
+	}
+	if strings.HasPrefix(strings.ToUpper(s), "FOR:") {
+		if nam, ok := lexIdent(s[4:]); ok && nam == s[4:] && !reserved(nam) {
+			return tok{tFOR, nam}, nil
+		}
+	}
 	if s == "_" || strings.EqualFold(s, "<nil>") {
 		return tok{tNIL, s}, nil
 	}
@@ -196,16 +934,19 @@ func lexIdent(src string) (string, bool) {
 		return "", false
 	}
 	src = strings.TrimSuffix(strings.TrimPrefix(src, "("), ")")
-	if len(src) < 1 {
-		return "", false
-	}
-	if strings.IndexFunc(src, func(r rune) bool {
-		return !(unicode.IsLetter(r) || unicode.IsDigit(r)) && r != '_'
-	}) >= 0 {
-		return "", false
-	}
-	if r, _ := utf8.DecodeRuneInString(src); unicode.IsDigit(r) {
-		return "", false
+	// Names of fields of nested structs are joined by dots.
+	for _, seg := range strings.Split(src, ".") {
+		if len(seg) < 1 {
+			return "", false
+		}
+		if strings.IndexFunc(seg, func(r rune) bool {
+			return !(unicode.IsLetter(r) || unicode.IsDigit(r)) && r != '_'
+		}) >= 0 {
+			return "", false
+		}
+		if r, _ := utf8.DecodeRuneInString(seg); unicode.IsDigit(r) {
+			return "", false
+		}
 	}
 	return src, true
 }
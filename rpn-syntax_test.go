@@ -0,0 +1,63 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// Build words each using the one before twice, and use the last.
+func doubleWords(n int) string {
+	src := ": w0 (x) ; "
+	for i := 1; i <= n; i++ {
+		src += fmt.Sprintf(": w%d w%d w%d + ; ", i, i-1, i-1)
+	}
+	return src + fmt.Sprintf("w%d", n)
+}
+
+func TestWordSize(t *testing.T) {
+	e, err := CompileRPN(doubleWords(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := e.Eval(map[string]interface{}{"x": int64(3)}); err != nil || r.Cmp(big.NewRat(48, 1)) != 0 {
+		t.Errorf("w4 gave %v, %v; want 48", r, err)
+	}
+	// Definitions which double in size are caught while they are defined.
+	if _, err := CompileRPN(doubleWords(64)); err == nil {
+		t.Error("no error for doubled words")
+	} else if _, ok := err.(WordSizeError); !ok {
+		t.Errorf("wrong error for doubled words: %v", err)
+	}
+	// So are many uses of a large word.
+	src := ": w " + strings.Repeat("(x) + ", 1000) + "; 0 " + strings.Repeat("w ", 100)
+	if _, err := CompileRPN(src); err == nil {
+		t.Error("no error for many uses of a word")
+	} else if _, ok := err.(WordSizeError); !ok {
+		t.Errorf("wrong error for many uses of a word: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import "math/big"
+
+// Limit on the degree of polynomials summed in closed form.
+const maxSumDegree = 64
+
+// Rewrite a sum of a polynomial in its index in closed form, using Faulhaber's
+// formula for the sum of each power.
+func (s *Simplifier) sum(nn *AST) string {
+	f, body := nn.Children[0], nn.Children[1]
+	b := f.Val.(*Binding)
+	l, h := f.Children[0], f.Children[1]
+	if s.Mode == Loose {
+		// Bounds not known to be integers keep the loop's type check as
+		// bound|0, which fails on fractions as FOR does.
+		if !isint(l) {
+			l = newAST(oOR, nil, l.clone(), constAST(new(big.Rat)))
+		}
+		if !isint(h) {
+			h = newAST(oOR, nil, h.clone(), constAST(new(big.Rat)))
+		}
+	}
+	ex := &expander{DefaultMaxOps}
+	lo, hi := ex.toPoly(l), ex.toPoly(h)
+	// Split the body into coefficients of the powers of the index.
+	coefs := make(map[int]poly)
+	for _, t := range ex.toPoly(body.inline()) {
+		k, rest := 0, make([]factor, 0, len(t.mono))
+		for _, g := range t.mono {
+			switch {
+			case g.atom.Op == oRECALL && g.atom.Val == b:
+				k = g.pow
+			case recalls(g.atom, b):
+				return ""
+			default:
+				rest = append(rest, g)
+			}
+		}
+		if k > maxSumDegree {
+			return ""
+		}
+		if coefs[k] == nil {
+			coefs[k] = poly{}
+		}
+		coefs[k].add(t.coef, rest)
+	}
+	// series(i, lo, hi, i**k) == S(hi) - S(lo-1), where S(n) is the sum of i**k
+	// from 1 to n, provided lo <= hi+1.
+	below := lo.plus(constPoly(big.NewRat(-1, 1)))
+	r := poly{}
+	for k, c := range coefs {
+		sh, ok := powerSum(k, hi)
+		if !ok {
+			return ""
+		}
+		sl, ok := powerSum(k, below)
+		if !ok {
+			return ""
+		}
+		p, ok := c.times(sh.plus(sl.scale(big.NewRat(-1, 1))))
+		if !ok {
+			return ""
+		}
+		r = r.plus(p)
+	}
+	count := hi.plus(below.scale(big.NewRat(-1, 1))).ast(ex)
+	sum := r.factor(ex)
+	if ex.left < 0 {
+		return ""
+	}
+	if !s.need(Integer, l) || !s.need(Integer, h) || !s.need(NotNegative, count) || !s.need(Defined, body) {
+		return ""
+	}
+	replace(nn, sum)
+	return "series(i, a, b, p(i)) == closed form"
+}
+
+// Rewrite products of the index plus a constant as MULRANGE, and products of
+// constants as EXP.
+func (s *Simplifier) prod(nn *AST) string {
+	f, body := nn.Children[0], nn.Children[1]
+	b := f.Val.(*Binding)
+	lo, hi := f.Children[0], f.Children[1]
+	if s.Mode == Strict {
+		// MULRANGE and EXP can overflow or fail where the product does not.
+		return ""
+	}
+	switch {
+	case body.Op == oRECALL && body.Val == b:
+		replace(nn, newAST(oMULRANGE, nil, lo, hi))
+		return "prod(i, a, b, i) == mulrange(a, b)"
+	case body.Op == oADD && (body.Children[0].Op == oRECALL && body.Children[0].Val == b || body.Children[1].Op == oRECALL && body.Children[1].Val == b):
+		c := body.Children[1]
+		if c.Op == oRECALL && c.Val == b {
+			c = body.Children[0]
+		}
+		if recalls(c, b) || !s.need(Integer, c) || !s.need(Integer, lo) || !s.need(Integer, hi) {
+			return ""
+		}
+		replace(nn, newAST(oMULRANGE, nil, newAST(oADD, nil, lo, c.clone()), newAST(oADD, nil, hi, c)))
+		return "prod(i, a, b, i+c) == mulrange(a+c, b+c)"
+	case !recalls(body, b):
+		count := newAST(oADD, nil, newAST(oSUB, nil, hi.clone(), lo.clone()), constAST(big.NewRat(1, 1)))
+		if !s.need(Integer, body) || !s.need(Integer, lo) || !s.need(Integer, hi) || !s.need(NotNegative, count) || !s.need(Defined, body) {
+			return ""
+		}
+		replace(nn, newAST(oEXP, nil, body, count, &AST{Op: oCONST}))
+		return "prod(i, a, b, c) == exp(c, b-a+1)"
+	}
+	return ""
+}
+
+// Determine whether a subtree uses a binding.
+func recalls(nn *AST, b *Binding) bool {
+	if nn.Op == oRECALL && nn.Val == b {
+		return true
+	}
+	for _, child := range nn.Children {
+		if recalls(child, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compute the sum of i**k for i from 1 to n as a polynomial in n.
+func powerSum(k int, n poly) (poly, bool) {
+	// S(n) = 1/(k+1) * sum(binomial(k+1, j) * B(j) * n**(k+1-j)) for j from
+	// 0 to k, where B(1) is +1/2.
+	bern := bernoulli(k)
+	r, np := poly{}, constPoly(big.NewRat(1, 1))
+	for e := 0; e <= k+1; e++ {
+		if j := k + 1 - e; j <= k {
+			c := new(big.Rat).SetInt(new(big.Int).Binomial(int64(k+1), int64(j)))
+			c.Mul(c, bern[j])
+			c.Quo(c, big.NewRat(int64(k+1), 1))
+			r = r.plus(np.scale(c))
+		}
+		if e <= k {
+			var ok bool
+			if np, ok = np.times(n); !ok {
+				return nil, false
+			}
+		}
+	}
+	return r, true
+}
+
+// Compute the Bernoulli numbers B(0) through B(k), with B(1) = +1/2.
+func bernoulli(k int) []*big.Rat {
+	b := make([]*big.Rat, k+1)
+	for m := 0; m <= k; m++ {
+		// B(m) = -1/(m+1) * sum(binomial(m+1, j) * B(j)) for j from 0 to
+		// m-1, with B(0) = 1.
+		s := new(big.Rat)
+		for j := 0; j < m; j++ {
+			c := new(big.Rat).SetInt(new(big.Int).Binomial(int64(m+1), int64(j)))
+			s.Add(s, c.Mul(c, b[j]))
+		}
+		if m == 0 {
+			s.SetInt64(-1)
+		}
+		b[m] = s.Quo(s, big.NewRat(-int64(m+1), 1))
+	}
+	if k >= 1 {
+		b[1].Neg(b[1])
+	}
+	return b
+}
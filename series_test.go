@@ -0,0 +1,59 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import "testing"
+
+// Series of polynomials in the index are written in closed form, which must
+// agree with the loop, including failing on fractional bounds.
+func TestSeriesClosedForm(t *testing.T) {
+	cases := []string{
+		"series(i, 1, n, i*i)",
+		"series(i, m, n, 3*i*i*i - i + m)",
+		"series(i, 2, 10, i*n)",
+	}
+	for _, src := range cases {
+		e, err := CompileGo(src)
+		if err != nil {
+			t.Fatal(src, err)
+		}
+		s := e.Slify()
+		if hasop(s.AST(), oSUM) {
+			t.Errorf("%s simplified to %v, which still has a loop", src, s)
+		}
+		for _, n := range []interface{}{int64(1), int64(7), "5/2"} {
+			vars := map[string]interface{}{"m": int64(2), "n": n}
+			want, werr := e.Eval(vars)
+			got, gerr := s.Eval(vars)
+			switch {
+			case werr != nil:
+				if _, ok := gerr.(TypeError); !ok {
+					t.Errorf("%s at n=%v: got %v, %v; want %v", s, n, got, gerr, werr)
+				}
+			case gerr != nil || got.Cmp(want) != 0:
+				t.Errorf("%s at n=%v: got %v, %v; want %v", s, n, got, gerr, want)
+			}
+		}
+	}
+}
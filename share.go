@@ -0,0 +1,193 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Compute each subtree which appears more than once only once, storing its
+// value to be recalled wherever it is used. The largest repeated subtree is
+// shared first, in a new LET at the lowest node containing all its
+// occurrences. Only root.Children[at] is changed.
+//
+// A value is computed outside the body of a SUM or PROD, which may be
+// evaluated no times, only if the simplifier's mode allows assuming it is
+// defined, and outside an operand of TRY or DEFAULT, whose errors are caught,
+// only if it is total. Otherwise, it is shared only by occurrences within the
+// same such operand.
+func (s *Simplifier) share(root *AST, at int) {
+	for n := 1; ; n++ {
+		keys := make(map[*AST]string)
+		sizes := make(map[*AST]int)
+		shapeOf(root.Children[at], keys, sizes)
+		occs := make(map[string][]*AST)
+		// Keys of repeated values, in the order they were found to repeat.
+		var repeated []string
+		walk(root.Children[at], func(nn *AST) {
+			if len(nn.Children) == 0 || nn.Op == oSTORE {
+				return
+			}
+			k := keys[nn]
+			occs[k] = append(occs[k], nn)
+			if len(occs[k]) == 2 {
+				repeated = append(repeated, k)
+			}
+		})
+		sort.SliceStable(repeated, func(i, j int) bool {
+			return sizes[occs[repeated[i]][0]] > sizes[occs[repeated[j]][0]]
+		})
+		var best []*AST
+		for _, k := range repeated {
+			if best = s.shareable(occs[k]); best != nil {
+				break
+			}
+		}
+		if best == nil {
+			return
+		}
+		l := lca(best)
+		p, i := l.Parent, findme(l)
+		var before *Expr
+		if s.Explain {
+			before = l.expr()
+		}
+		b := &Binding{"t" + strconv.Itoa(n)}
+		val := best[0]
+		for _, nn := range best {
+			replace(nn, &AST{Op: oRECALL, Val: b})
+		}
+		let := newAST(oLET, nil, newAST(oSTORE, b, val), l)
+		let.Parent = p
+		p.Children[i] = let
+		if before != nil {
+			s.Steps = append(s.Steps, Step{"share common subexpression", before, let.expr()})
+		}
+	}
+}
+
+// Choose occurrences of a repeated value which can share one computation: all
+// of them if it can be computed where they meet, or else the first several
+// within the same conditionally evaluated operand. If there are none, the
+// result is nil.
+func (s *Simplifier) shareable(occs []*AST) []*AST {
+	l, val := lca(occs), occs[0]
+	loop, guard := false, false
+	for _, nn := range occs {
+		for ; nn != l; nn = nn.Parent {
+			switch {
+			case !conditional(nn):
+			case nn.Parent.Op == oTRY || nn.Parent.Op == oDEFAULT:
+				guard = true
+			default:
+				loop = true
+			}
+		}
+	}
+	if !guard && !loop || total(val) || !guard && s.need(Defined, val) {
+		return occs
+	}
+	// Group the occurrences by the innermost conditional operand containing
+	// them.
+	regions := make(map[*AST][]*AST)
+	in := make([]*AST, len(occs))
+	for i, occ := range occs {
+		nn := occ
+		for nn.Parent != nil && !conditional(nn) {
+			nn = nn.Parent
+		}
+		regions[nn] = append(regions[nn], occ)
+		in[i] = nn
+	}
+	for _, r := range in {
+		if len(regions[r]) > 1 {
+			return regions[r]
+		}
+	}
+	return nil
+}
+
+// Check whether a node is an operand which may not be evaluated, or whose
+// errors may be caught: the body of a SUM or PROD or an operand of TRY or
+// DEFAULT.
+func conditional(nn *AST) bool {
+	switch p := nn.Parent; p.Op {
+	case oSUM, oPROD:
+		return p.Children[1] == nn
+	case oTRY, oDEFAULT:
+		return true
+	}
+	return false
+}
+
+// Compute a key for each node which is equal for structurally identical
+// subtrees, along with the number of nodes in each subtree.
+func shapeOf(nn *AST, keys map[*AST]string, sizes map[*AST]int) {
+	k := fmt.Sprintf("(%d", nn.Op)
+	switch v := nn.Val.(type) {
+	case nil:
+	case string:
+		k += " " + strconv.Quote(v)
+	case *Binding:
+		k += fmt.Sprintf(" %p", v)
+	default:
+		k += fmt.Sprintf(" %T %v", v, v)
+	}
+	size := 1
+	for _, child := range nn.Children {
+		shapeOf(child, keys, sizes)
+		k += " " + keys[child]
+		size += sizes[child]
+	}
+	keys[nn], sizes[nn] = k+")", size
+}
+
+// Find the lowest common ancestor of several nodes, none of which is an
+// ancestor of another.
+func lca(nodes []*AST) *AST {
+	depth := func(nn *AST) (d int) {
+		for ; nn.Parent != nil; nn = nn.Parent {
+			d++
+		}
+		return d
+	}
+	l := nodes[0]
+	for _, nn := range nodes[1:] {
+		a, b := l, nn
+		da, db := depth(a), depth(b)
+		for ; da > db; da-- {
+			a = a.Parent
+		}
+		for ; db > da; db-- {
+			b = b.Parent
+		}
+		for a != b {
+			a, b = a.Parent, b.Parent
+		}
+		l = a
+	}
+	return l
+}
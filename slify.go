@@ -25,12 +25,177 @@ package rpn
 
 import "math/big"
 
+// Simplification modes.
+type SlifyMode uint8
+
+const (
+	// Loose simplification assumes that variables are present and that
+	// divisors and operands of shifts and ranges are in bounds, so it may hide
+	// errors other than type errors. It also assumes that the ranges of sums
+	// and products are not empty. This is the mode of Expr.Slify.
+	Loose SlifyMode = iota
+	// Strict simplification never changes whether evaluation fails, nor
+	// whether a failure is one that try recovers from.
+	Strict
+	// Assume simplification rewrites regardless of side conditions, recording
+	// those it needs in the simplifier's Assumptions.
+	Assume
+)
+
+// Side conditions on simplifications.
+type Condition uint8
+
+const (
+	// The subexpression is not zero.
+	NonZero Condition = iota
+	// The subexpression evaluates to an integer.
+	Integer
+	// The subexpression evaluates without error.
+	Defined
+	// The subexpression is not negative.
+	NotNegative
+)
+
+// A condition on a subexpression under which a simplified expression is
+// equivalent to the original.
+type Assumption struct {
+	Cond Condition
+	Expr *Expr
+}
+
+func (a Assumption) String() string {
+	switch a.Cond {
+	case NonZero:
+		return a.Expr.String() + " != 0"
+	case Integer:
+		return "int(" + a.Expr.String() + ")"
+	case Defined:
+		return "defined(" + a.Expr.String() + ")"
+	case NotNegative:
+		return a.Expr.String() + " >= 0"
+	}
+	panic("unknown condition!")
+}
+
+// Simplification context.
+type Simplifier struct {
+	Mode SlifyMode
+	// Conditions assumed by the last simplification in Assume mode.
+	Assumptions []Assumption
+	// Whether to record the steps of simplification.
+	Explain bool
+	// Steps of the last simplification, if Explain is set.
+	Steps []Step
+}
+
+// A simplification step: a named rewrite, with the subexpression to which it
+// was applied and the result.
+type Step struct {
+	Rule          string
+	Before, After *Expr
+}
+
+// Simplify an expression according to the simplifier's mode, giving a new
+// expression. Subexpressions which appear more than once are then computed
+// only once.
+func (s *Simplifier) Slify(e *Expr) *Expr {
+	s.Assumptions, s.Steps = nil, nil
+	ast := e.AST()
+	// The act of creating the AST removes all NOPs.
+	for _, nn := range ast.Children {
+		s.fold(nn)
+	}
+	for s.redundant(ast) {
+		// Rewrites can leave new constant subexpressions behind.
+		for _, nn := range ast.Children {
+			s.fold(nn)
+		}
+	}
+	for i, nn := range ast.Children {
+		if results(nn.Op) == 1 {
+			s.share(ast, i)
+			continue
+		}
+		// A value shared by operands of an operation with several results
+		// must be stored inside each operand.
+		for j := range nn.Children {
+			s.share(nn, j)
+		}
+	}
+	return ast.expr()
+}
+
+// Fold constants, recording each constant subexpression folded.
+func (s *Simplifier) fold(nn *AST) {
+	if !s.Explain || nn.Parent == nil {
+		foldConsts(nn)
+		return
+	}
+	if nn.Op != oCONST && !hasop(nn, oLOAD) && !hasop(nn, oRECALL) {
+		before, p, i := nn.expr(), nn.Parent, findme(nn)
+		if foldConsts(nn); nn.Op == oCONST {
+			s.Steps = append(s.Steps, Step{"fold constants", before, p.Children[i].expr()})
+			return
+		}
+	}
+	for _, child := range nn.Children {
+		s.fold(child)
+	}
+}
+
+// Check whether a rewrite may rely on a condition holding for nn.
+func (s *Simplifier) need(c Condition, nn *AST) bool {
+	switch {
+	case c == NonZero && nn.Op == oCONST && nn.Val != nil && !eqzero(nn.Val),
+		c == Integer && isint(nn),
+		c == Defined && total(nn),
+		c == NotNegative && nonneg(nn):
+		return true
+	case s.Mode == Loose:
+		return c == NonZero || c == NotNegative || c == Defined && typesafe(nn)
+	case s.Mode == Strict:
+		return false
+	}
+	a := Assumption{c, nn.expr()}
+	for _, b := range s.Assumptions {
+		if b.Cond == a.Cond && b.Expr.String() == a.Expr.String() {
+			return true
+		}
+	}
+	s.Assumptions = append(s.Assumptions, a)
+	return true
+}
+
+// Check whether a rewrite may evaluate x and y in the other order. Whichever
+// fails first gives the error, which try may or may not recover from, so
+// outside Loose mode both must be defined.
+func (s *Simplifier) swappable(x, y *AST) bool {
+	if s.Mode == Loose {
+		return true
+	}
+	return s.need(Defined, x) && s.need(Defined, y)
+}
+
 func foldConsts(nn *AST) {
 	for _, child := range nn.Children {
 		foldConsts(child)
 	}
 	switch nn.Op {
-	case oNOP, oCONST, oLOAD: // do nothing
+	case oNOP, oCONST, oLOAD, oSTORE, oRECALL, oLET, oFOR, oSUM, oPROD, oDIVMOD, oEGCD, oCRT, oTRY, oDEFAULT: // do nothing
+	case oADDN, oMIN, oMAX, oGCDN, oLCM:
+		v := Evaluator{
+			Stack:  make([]interface{}, 0, len(nn.Children)),
+			Counts: []int{len(nn.Children)},
+		}
+		for _, child := range nn.Children {
+			if child.Op != oCONST || child.Val == nil {
+				return
+			}
+			v.Stack = append(v.Stack, child.Val)
+		}
+		if opFuncs[nn.Op](&v) == nil {
+			setconst(nn, v.Top())
+		}
 	case oABS, oNEG, oNOT, oDENOM, oINV, oNUM, oTRUNC, oFLOOR, oCEIL:
 		child := nn.Children[0]
 		if child.Op == oCONST {
@@ -75,35 +240,63 @@ func foldConsts(nn *AST) {
 	}
 }
 
-func redundant(nn *AST) (changed bool) {
+func (s *Simplifier) redundant(nn *AST) (changed bool) {
 	for _, child := range nn.Children {
-		if redundant(child) {
+		if s.redundant(child) {
 			changed = true
 		}
 	}
+	var before *Expr
+	var p *AST
+	var i int
+	if s.Explain && nn.Parent != nil {
+		before, p, i = nn.expr(), nn.Parent, findme(nn)
+	}
+	if rule := s.rewrite(nn); rule != "" {
+		if before != nil {
+			s.Steps = append(s.Steps, Step{rule, before, p.Children[i].expr()})
+		}
+		return true
+	}
+	return changed
+}
+
+// Apply a rewrite to a node, returning its name or "" if none applies.
+func (s *Simplifier) rewrite(nn *AST) string {
 	switch nn.Op {
 	case oNOP: // do nothing
+	case oTRY:
+		// Recovery is unneeded if nothing can fail, regardless of mode.
+		if x := nn.Children[0]; total(x) {
+			linkpast(nn, x)
+			return "try(x, y) == x when x cannot fail"
+		}
+	case oDEFAULT:
+		if x := nn.Children[0]; !hasop(x, oLOAD) {
+			linkpast(nn, x)
+			return "default(x, y) == x when x has no variables"
+		}
 	case oNEG:
 		// NEG NEG is redundant
 		if x := nn.Children[0]; x.Op == oNEG {
 			linkpast(nn, x.Children[0])
-			return true
-		} else if x.Op == oSUB {
+			return "--x == x"
+		} else if x.Op == oSUB && s.swappable(x.Children[0], x.Children[1]) {
 			// -(x-y) == y-x
 			x.Children[0], x.Children[1] = x.Children[1], x.Children[0]
 			linkpast(nn, x)
-			return true
+			return "-(x-y) == y-x"
 		}
 	case oINV:
 		// INV INV is redundant
-		if x := nn.Children[0]; x.Op == oINV {
+		if x := nn.Children[0]; x.Op == oINV && s.need(NonZero, x.Children[0]) {
 			linkpast(nn, x.Children[0])
-			return true
-		} else if x.Op == oQUO {
+			return "1/(1/x) == x"
+		} else if x.Op == oQUO && s.need(NonZero, x.Children[1]) && s.swappable(x.Children[0], x.Children[1]) {
 			// 1/(x/y) == y/x
 			x.Children[0], x.Children[1] = x.Children[1], x.Children[0]
 			linkpast(nn, x)
-			return true
+			return "1/(x/y) == y/x"
 		}
 	case oMUL:
 		x, y := nn.Children[0], nn.Children[1]
@@ -112,38 +305,56 @@ func redundant(nn *AST) (changed bool) {
 			// -x*-y == x*y
 			linkpast(x, x.Children[0])
 			linkpast(y, y.Children[0])
-			return true
-		case x.Op == oINV:
+			return "-x * -y == x*y"
+		case x.Op == oINV && s.swappable(x, y):
 			if y.Op == oINV {
 				// 1/x * 1/y == 1/(x*y)
 				linkpast(x, x.Children[0])
 				linkpast(y, y.Children[0])
-				ins := &AST{oINV, nil, []*AST{nn}, nn.Parent}
+				ins := &AST{oINV, nil, []*AST{nn}, nn.Parent, Span{}}
 				if nn.Parent != nil {
 					nn.Parent.Children[findme(nn)] = ins
 				}
 				nn.Parent = ins
-				return true
+				return "1/x * 1/y == 1/(x*y)"
 			} else {
 				// 1/x * y == y/x
 				linkpast(x, x.Children[0])
 				nn.Children[0], nn.Children[1] = nn.Children[1], nn.Children[0]
 				nn.Op = oQUO
-				return true
+				return "1/x * y == y/x"
 			}
 		case y.Op == oINV:
 			// x * 1/y == x/y
 			linkpast(y, y.Children[0])
 			nn.Op = oQUO
-			return true
+			return "x * 1/y == x/y"
 		case x.Op == oCONST && eqone(x.Val):
 			// 1 * y == y
 			linkpast(nn, y)
-			return true
+			return "1*y == y"
 		case y.Op == oCONST && eqone(y.Val):
 			// x * 1 == x
 			linkpast(nn, x)
-			return true
+			return "x*1 == x"
+		case iszero(x) && s.need(Defined, y), iszero(y) && s.need(Defined, x):
+			// 0 * y == x * 0 == 0
+			setconst(nn, new(big.Int))
+			return "x*0 == 0"
+		case reassocMul(nn):
+			// (x*2)*3 == x*6
+			return "(x*a)*b == x*(a*b)"
+		case pow2(y) > 0 && s.need(Integer, x):
+			// x * 2**k == x << k
+			y.Val = big.NewInt(int64(pow2(y)))
+			nn.Op = oLSH
+			return "x * 2**k == x << k"
+		case pow2(x) > 0 && s.need(Integer, y):
+			// 2**k * y == y << k
+			x.Val = big.NewInt(int64(pow2(x)))
+			nn.Children[0], nn.Children[1] = y, x
+			nn.Op = oLSH
+			return "2**k * y == y << k"
 		}
 	case oQUO:
 		x, y := nn.Children[0], nn.Children[1]
@@ -152,34 +363,401 @@ func redundant(nn *AST) (changed bool) {
 			// -x*-y == x*y
 			linkpast(x, x.Children[0])
 			linkpast(y, y.Children[0])
-			return true
+			return "-x / -y == x/y"
 		case x.Op == oINV:
-			if y.Op == oINV {
+			if y.Op == oINV && s.need(NonZero, y.Children[0]) && s.swappable(x.Children[0], y.Children[0]) {
 				// 1/x / 1/y == y/x
 				linkpast(x, x.Children[0])
 				linkpast(y, y.Children[0])
 				nn.Children[0], nn.Children[1] = nn.Children[1], nn.Children[0]
-				return true
+				return "1/x / 1/y == y/x"
 			}
 			// 1/x / y == 1/(x*y), but that's the same number of operations.
-		case y.Op == oINV:
+		case y.Op == oINV && s.need(NonZero, y.Children[0]):
 			// x / 1/y == x*y
 			linkpast(y, y.Children[0])
 			nn.Op = oMUL
-			return true
+			return "x / 1/y == x*y"
 		case x.Op == oCONST && eqone(x.Val):
 			// 1 / y == 1/y (nowai)
 			nn.Children[0], x.Parent = nil, nil
 			nn.Op = oINV
 			nn.Children = nn.Children[1:]
-			return true
+			return "1/y == inv(y)"
 		case y.Op == oCONST && eqone(y.Val):
 			// x / 1 == x
 			linkpast(nn, x)
+			return "x/1 == x"
+		case reassocMul(nn):
+			// (x*2)/4 == x/2
+			return "(x*a)/b == x*(a/b)"
+		case equalAST(x, y) && s.need(NonZero, x) && s.need(Defined, x):
+			// x / x == 1
+			setconst(nn, big.NewInt(1))
+			return "x/x == 1"
+		}
+	case oADDN:
+		// Sums of several operands are written as additions so that the
+		// rules for those apply.
+		x := nn.Children[0]
+		for _, y := range nn.Children[1:] {
+			x = newAST(oADD, nil, x, y)
+		}
+		replace(nn, x)
+		return "sum(x, y, ...) == x + y + ..."
+	case oADD:
+		x, y := nn.Children[0], nn.Children[1]
+		switch {
+		case iszero(x):
+			// 0 + y == y
+			linkpast(nn, y)
+			return "0+y == y"
+		case iszero(y):
+			// x + 0 == x
+			linkpast(nn, x)
+			return "x+0 == x"
+		case reassocAdd(nn):
+			// (x+1)+2 == x+3
+			return "(x+a)+b == x+(a+b)"
+		}
+	case oSUB:
+		x, y := nn.Children[0], nn.Children[1]
+		switch {
+		case iszero(y):
+			// x - 0 == x
+			linkpast(nn, x)
+			return "x-0 == x"
+		case iszero(x):
+			// 0 - y == -y
+			nn.Children[0], x.Parent = nil, nil
+			nn.Op = oNEG
+			nn.Children = nn.Children[1:]
+			return "0-y == -y"
+		case equalAST(x, y) && s.need(Defined, x):
+			// x - x == 0
+			setconst(nn, new(big.Int))
+			return "x-x == 0"
+		case reassocAdd(nn):
+			// (x+1)-2 == x-1
+			return "(x+a)-b == x+(a-b)"
+		}
+	case oABS:
+		if x := nn.Children[0]; x.Op == oABS || x.Op == oNEG {
+			// ABS ABS == ABS NEG == ABS
+			linkpast(x, x.Children[0])
+			return "abs(abs(x)) == abs(-x) == abs(x)"
+		}
+	case oNOT:
+		// NOT NOT is redundant for integers
+		if x := nn.Children[0]; x.Op == oNOT && s.need(Integer, x.Children[0]) {
+			linkpast(nn, x.Children[0])
+			return "^^x == x"
+		}
+	case oTRUNC, oFLOOR, oCEIL, oNUM:
+		// Rounding an integer does nothing, nor does taking its numerator.
+		if x := nn.Children[0]; isint(x) {
+			linkpast(nn, x)
+			return "round(x) == num(x) == x for integer x"
+		}
+	case oDENOM:
+		if x := nn.Children[0]; isint(x) && s.need(Defined, x) {
+			setconst(nn, big.NewInt(1))
+			return "denom(x) == 1 for integer x"
+		}
+	case oAND, oOR, oXOR, oANDNOT:
+		x, y := nn.Children[0], nn.Children[1]
+		// Removing an operand of these could hide a type error.
+		switch {
+		case equalAST(x, y) && (nn.Op == oAND || nn.Op == oOR) && s.need(Integer, x):
+			// x & x == x | x == x
+			linkpast(nn, x)
+			return "x&x == x|x == x"
+		case equalAST(x, y) && s.need(Integer, x) && s.need(Defined, x):
+			// x ^ x == x &^ x == 0
+			setconst(nn, new(big.Int))
+			return "x^x == x&^x == 0"
+		case iszero(y) && nn.Op != oAND && s.need(Integer, x):
+			// x | 0 == x ^ 0 == x &^ 0 == x
+			linkpast(nn, x)
+			return "x|0 == x^0 == x&^0 == x"
+		case iszero(y) && s.need(Integer, x) && s.need(Defined, x):
+			// x & 0 == 0
+			setconst(nn, new(big.Int))
+			return "x&0 == 0"
+		case iszero(x) && (nn.Op == oOR || nn.Op == oXOR) && s.need(Integer, y):
+			// 0 | y == 0 ^ y == y
+			linkpast(nn, y)
+			return "0|y == 0^y == y"
+		case iszero(x) && s.need(Integer, y) && s.need(Defined, y):
+			// 0 & y == 0 &^ y == 0
+			setconst(nn, new(big.Int))
+			return "0&y == 0&^y == 0"
+		}
+	case oLSH, oRSH:
+		// x << 0 == x >> 0 == x
+		if x, y := nn.Children[0], nn.Children[1]; iszero(y) && s.need(Integer, x) {
+			linkpast(nn, x)
+			return "x<<0 == x>>0 == x"
+		}
+	case oDIV:
+		// x div 2**k == x >> k
+		if y := nn.Children[1]; pow2(y) > 0 {
+			y.Val = big.NewInt(int64(pow2(y)))
+			nn.Op = oRSH
+			return "div(x, 2**k) == x >> k"
+		}
+	case oMOD:
+		// x mod 2**k == x & (2**k - 1)
+		if y := nn.Children[1]; pow2(y) > 0 {
+			y.Val = new(big.Int).Sub(y.Val.(*big.Int), intOne)
+			nn.Op = oAND
+			return "mod(x, 2**k) == x & (2**k-1)"
+		}
+	case oSUM:
+		return s.sum(nn)
+	case oPROD:
+		return s.prod(nn)
+	}
+	return ""
+}
+
+// Fold constants across nested additions and subtractions, rewriting
+// nn = A±c or c±A, where A is z±k or k±z, to z±(c±k) or (c±k)-z.
+func reassocAdd(nn *AST) bool {
+	x, y := nn.Children[0], nn.Children[1]
+	inner, s := x, 1
+	c, ok := constOf(y)
+	if ok {
+		if nn.Op == oSUB {
+			c.Neg(c)
+		}
+	} else if c, ok = constOf(x); ok {
+		inner = y
+		if nn.Op == oSUB {
+			s = -1
+		}
+	} else {
+		return false
+	}
+	if inner.Op != oADD && inner.Op != oSUB {
+		return false
+	}
+	z, k := inner.Children[0], inner.Children[1]
+	sz := 1
+	kv, ok := constOf(k)
+	if !ok {
+		if kv, ok = constOf(z); !ok {
+			return false
+		}
+		z = k
+		if inner.Op == oSUB {
+			sz = -1
+		}
+	} else if inner.Op == oSUB {
+		kv.Neg(kv)
+	}
+	// nn = s*(sz*z + kv) + c
+	if s < 0 {
+		kv.Neg(kv)
+	}
+	kv.Add(kv, c)
+	var nw *AST
+	switch {
+	case s*sz > 0 && kv.Sign() == 0:
+		nw = z
+	case s*sz > 0 && kv.Sign() > 0:
+		nw = newAST(oADD, nil, z, constAST(kv))
+	case s*sz > 0:
+		nw = newAST(oSUB, nil, z, constAST(kv.Neg(kv)))
+	case kv.Sign() == 0:
+		nw = newAST(oNEG, nil, z)
+	default:
+		nw = newAST(oSUB, nil, constAST(kv), z)
+	}
+	replace(nn, nw)
+	return true
+}
+
+// Fold constants across nested multiplications and divisions by constants,
+// rewriting nn = A*c, c*A, or A/c, where A is z*k, k*z, or z/k, to z*(c*k).
+func reassocMul(nn *AST) bool {
+	x, y := nn.Children[0], nn.Children[1]
+	inner := x
+	c, ok := constOf(y)
+	if ok && nn.Op == oQUO {
+		if c.Sign() == 0 {
+			return false
+		}
+		c.Inv(c)
+	} else if !ok && nn.Op == oMUL {
+		if c, ok = constOf(x); !ok {
+			return false
+		}
+		inner = y
+	} else if !ok {
+		return false
+	}
+	var z *AST
+	var k *big.Rat
+	switch inner.Op {
+	case oMUL:
+		if k, ok = constOf(inner.Children[1]); ok {
+			z = inner.Children[0]
+		} else if k, ok = constOf(inner.Children[0]); ok {
+			z = inner.Children[1]
+		}
+	case oQUO:
+		if k, ok = constOf(inner.Children[1]); ok && k.Sign() != 0 {
+			z = inner.Children[0]
+			k.Inv(k)
+		}
+	}
+	if z == nil {
+		return false
+	}
+	k.Mul(k, c)
+	var nw *AST
+	switch {
+	case eqone(k):
+		nw = z
+	case k.Num().Cmp(intOne) == 0:
+		nw = newAST(oQUO, nil, z, constAST(new(big.Rat).SetInt(k.Denom())))
+	default:
+		nw = newAST(oMUL, nil, z, constAST(k))
+	}
+	replace(nn, nw)
+	return true
+}
+
+// Determine whether a subtree contains an operation.
+func hasop(nn *AST, op operator) bool {
+	if nn.Op == op {
+		return true
+	}
+	for _, child := range nn.Children {
+		if hasop(child, op) {
 			return true
 		}
 	}
-	return changed
+	return false
+}
+
+// Determine whether a subtree never evaluates to a negative value.
+func nonneg(nn *AST) bool {
+	ranges, _ := Analyze(nn, nil)
+	return ranges[nn].lower().sign() >= 0
+}
+
+// Determine whether evaluating a subtree can never fail.
+func total(nn *AST) bool {
+	for _, child := range nn.Children {
+		if !total(child) {
+			return false
+		}
+	}
+	switch nn.Op {
+	case oCONST, oABS, oADD, oMUL, oNEG, oSUB, oDENOM, oNUM, oTRUNC, oFLOOR, oCEIL, oSTORE, oRECALL, oLET, oSUM, oPROD, oADDN, oMIN, oMAX, oTRY, oDEFAULT:
+		return true
+	case oAND, oANDNOT, oGCD, oOR, oXOR, oNOT, oFOR, oGCDN, oLCM:
+		return typesafe(nn)
+	}
+	return false
+}
+
+// Determine whether evaluating a subtree can never cause a type error.
+func typesafe(nn *AST) bool {
+	for _, child := range nn.Children {
+		if !typesafe(child) {
+			return false
+		}
+	}
+	switch nn.Op {
+	case oNOT:
+		return isint(nn.Children[0])
+	case oAND, oANDNOT, oBINOMIAL, oDIV, oGCD, oLSH, oMOD, oMODINVERSE, oMULRANGE, oOR, oREM, oRSH, oXOR, oFOR:
+		return isint(nn.Children[0]) && isint(nn.Children[1])
+	case oEXP:
+		m := nn.Children[2]
+		return isint(nn.Children[0]) && isint(nn.Children[1]) && (m.Val == nil || isint(m))
+	case oGCDN, oLCM, oDIVMOD, oEGCD, oCRT:
+		return allint(nn.Children)
+	}
+	return true
+}
+
+// Get the value of a constant node.
+func constOf(nn *AST) (*big.Rat, bool) {
+	if nn.Op != oCONST || nn.Val == nil {
+		return nil, false
+	}
+	return ratOf(nn.Val), true
+}
+
+func iszero(nn *AST) bool {
+	return nn.Op == oCONST && nn.Val != nil && eqzero(nn.Val)
+}
+
+// Get k if nn is the constant 2**k, or 0 otherwise.
+func pow2(nn *AST) int {
+	if nn.Op == oCONST {
+		if v, ok := nn.Val.(*big.Int); ok && v.Sign() > 0 && uint(v.BitLen()-1) == v.TrailingZeroBits() {
+			return v.BitLen() - 1
+		}
+	}
+	return 0
+}
+
+// Turn a node into a constant, detaching its children.
+func setconst(nn *AST, val interface{}) {
+	for i, child := range nn.Children {
+		child.Parent = nil
+		nn.Children[i] = nil
+	}
+	nn.Children, nn.Op, nn.Val = nil, oCONST, val
+}
+
+// Determine whether a subtree always evaluates to an integer, if it evaluates
+// at all.
+func isint(nn *AST) bool {
+	switch nn.Op {
+	case oCONST:
+		_, ok := nn.Val.(*big.Int)
+		return ok
+	case oAND, oANDNOT, oBINOMIAL, oDIV, oGCD, oLSH, oMOD, oMODINVERSE, oMULRANGE, oNOT, oOR, oREM, oRSH, oXOR, oDENOM, oNUM, oTRUNC, oFLOOR, oCEIL, oGCDN, oLCM, oDIVMOD, oEGCD, oCRT:
+		return true
+	case oADDN, oMIN, oMAX, oTRY, oDEFAULT:
+		return allint(nn.Children)
+	case oABS, oNEG, oSTORE:
+		return isint(nn.Children[0])
+	case oLET:
+		return isint(nn.Children[1])
+	case oRECALL:
+		switch b := binder(nn); {
+		case b == nil:
+		case b.Op == oFOR:
+			return true
+		default:
+			return isint(b.Children[0])
+		}
+	case oSUM, oPROD:
+		return isint(nn.Children[1])
+	case oADD, oSUB, oMUL:
+		return isint(nn.Children[0]) && isint(nn.Children[1])
+	case oEXP:
+		// A negative exponent gives a fraction even with a modulus.
+		y, ok := nn.Children[1].Val.(*big.Int)
+		return nn.Children[1].Op == oCONST && ok && y.Sign() >= 0
+	}
+	return false
+}
+
+func allint(nodes []*AST) bool {
+	for _, nn := range nodes {
+		if !isint(nn) {
+			return false
+		}
+	}
+	return true
 }
 
 func linkpast(nn, ch *AST) {
@@ -0,0 +1,83 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Strict simplification must not reorder operands which may fail, since the
+// first failure decides whether try recovers.
+func TestStrictOperandOrder(t *testing.T) {
+	cases := []string{
+		"try(-(a/0 - b), 1)",
+		"try(inv(a)*inv(b), 1)",
+		"try(inv(a)*b, 1)",
+		"try(inv(a/0/b), 1)",
+		"try(inv(a/0)/inv(b), 1)",
+		"-(a/0 - b)",
+	}
+	vars := map[string]interface{}{"a": int64(0)}
+	for _, src := range cases {
+		e, err := CompileGo(src)
+		if err != nil {
+			t.Fatal(src, err)
+		}
+		s := (&Simplifier{Mode: Strict}).Slify(e)
+		want, werr := e.Eval(vars)
+		got, gerr := s.Eval(vars)
+		switch {
+		case werr != nil:
+			if reflect.TypeOf(gerr) != reflect.TypeOf(werr) {
+				t.Errorf("%s simplified to %v: got %v, %v; want %v", src, s, got, gerr, werr)
+			}
+		case gerr != nil || got.Cmp(want) != 0:
+			t.Errorf("%s simplified to %v: got %v, %v; want %v", src, s, got, gerr, want)
+		}
+	}
+}
+
+// Assume simplification reorders the operands, recording that both are
+// defined.
+func TestAssumeOperandOrder(t *testing.T) {
+	e, err := CompileGo("-(a - b)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Simplifier{Mode: Assume}
+	r := s.Slify(e)
+	if got := r.String(); got != "(b) (a) -" {
+		t.Errorf("simplified to %s, want (b) (a) -", got)
+	}
+	var got []string
+	for _, a := range s.Assumptions {
+		if a.Cond == Defined {
+			got = append(got, a.Expr.String())
+		}
+	}
+	if want := []string{"(a)", "(b)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("assumed %v defined, want %v", got, want)
+	}
+}
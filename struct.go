@@ -0,0 +1,172 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"sync"
+)
+
+// Paths of indices to the variables in each struct type.
+var structFields = struct {
+	sync.RWMutex
+	m map[reflect.Type]map[string][]int
+}{m: make(map[reflect.Type]map[string][]int)}
+
+var (
+	bigIntType   = reflect.TypeOf(big.Int{})
+	bigRatType   = reflect.TypeOf(big.Rat{})
+	bigFloatType = reflect.TypeOf(big.Float{})
+	numberType   = reflect.TypeOf(json.Number(""))
+)
+
+// Evaluate an expression with variables given by the fields of a struct or
+// pointer to struct. Each exported field supplies the variable named by its
+// rpn tag, or by the field name if it has none; a tag of "-" skips the field.
+// Fields of nested structs are named by the outer and inner names joined by
+// a dot, like "req.amount", except that fields of embedded structs without
+// tags are promoted, and a struct nested within itself is not followed.
+// Fields may have any type accepted by Eval, including named types; nil
+// pointers are missing variables.
+func (e *Expr) EvalStruct(v interface{}) (*big.Rat, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, TypeError{"struct"}
+	}
+	return e.EvalWith(structVars{rv, fieldsOf(rv.Type())})
+}
+
+// A Resolver over the fields of a struct.
+type structVars struct {
+	v      reflect.Value
+	fields map[string][]int
+}
+
+func (s structVars) Lookup(name string) (interface{}, error) {
+	path, ok := s.fields[name]
+	if !ok {
+		return nil, MissingVar{name}
+	}
+	v := s.v
+	for _, i := range path {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return nil, MissingVar{name}
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, MissingVar{name}
+		}
+		v = v.Elem()
+	}
+	switch v.Type() {
+	case bigIntType, bigRatType, bigFloatType:
+		if !v.CanAddr() {
+			c := reflect.New(v.Type()).Elem()
+			c.Set(v)
+			v = c
+		}
+		v = v.Addr()
+	case numberType:
+		return json.Number(v.String()), nil
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	}
+	return v.Interface(), nil
+}
+
+// Get the variables in a struct type, computing them if necessary.
+func fieldsOf(t reflect.Type) map[string][]int {
+	structFields.RLock()
+	m, ok := structFields.m[t]
+	structFields.RUnlock()
+	if ok {
+		return m
+	}
+	m = make(map[string][]int)
+	addFields(m, t, "", nil, map[reflect.Type]bool{})
+	structFields.Lock()
+	structFields.m[t] = m
+	structFields.Unlock()
+	return m
+}
+
+func addFields(m map[string][]int, t reflect.Type, prefix string, path []int, seen map[reflect.Type]bool) {
+	if seen[t] {
+		// Recursive types would have infinitely many variables.
+		return
+	}
+	seen[t] = true
+	defer delete(seen, t)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("rpn")
+		if f.PkgPath != "" && !f.Anonymous || tag == "-" {
+			continue
+		}
+		p := append(path[:len(path):len(path)], i)
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		nested := ft.Kind() == reflect.Struct && ft != bigIntType && ft != bigRatType && ft != bigFloatType
+		if f.Anonymous && tag == "" {
+			if nested {
+				addFields(m, ft, prefix, p, seen)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name := tag
+		if name == "" {
+			name = f.Name
+		}
+		if nested {
+			addFields(m, ft, prefix+name+".", p, seen)
+			continue
+		}
+		if _, ok := m[prefix+name]; !ok || len(p) < len(m[prefix+name]) {
+			m[prefix+name] = p
+		}
+	}
+}
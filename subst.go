@@ -0,0 +1,120 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import "sort"
+
+// How Substitute treats a variable of a substituted expression whose name is
+// also used elsewhere in the result.
+type SubstPolicy int
+
+const (
+	// Variables with the same name are the same variable.
+	SubstShare SubstPolicy = iota
+	// Same names are a NameCollision error.
+	SubstReject
+	// Each variable of a substituted expression is renamed by prefixing the
+	// name of the variable it replaces and a dot, so that the variable a of
+	// an expression substituted for x becomes x.a. Names which still
+	// collide are a NameCollision error.
+	SubstPrefix
+)
+
+// Create a new expression in which each variable named in subs is replaced by
+// the corresponding expression. Substitution is simultaneous: variables of the
+// substituted expressions are not themselves replaced. A variable of a
+// substituted expression collides if it has the same name as a variable which
+// remains in the receiver or one of another substituted expression; policy
+// determines how collisions are handled. A substituted expression with
+// several results is a LargeStack error. Neither the receiver nor the
+// substituted expressions are modified.
+func (e *Expr) Substitute(subs map[string]*Expr, policy SubstPolicy) (*Expr, error) {
+	ast := e.AST()
+	trees := make(map[string]*AST, len(subs))
+	owner := make(map[string]string)
+	for _, name := range e.names {
+		if subs[name] == nil {
+			owner[name] = ""
+		}
+	}
+	// Visit substitutions in order so that the collision reported is
+	// consistent.
+	keys := make([]string, 0, len(subs))
+	for x := range subs {
+		keys = append(keys, x)
+	}
+	sort.Strings(keys)
+	for _, x := range keys {
+		sub := subs[x]
+		if sub == nil {
+			continue
+		}
+		root := sub.AST()
+		if len(root.Children) != 1 || results(root.Children[0].Op) > 1 {
+			return nil, LargeStack{}
+		}
+		t := root.Children[0]
+		seen := make(map[string]bool)
+		var err error
+		walk(t, func(nn *AST) {
+			nn.Span = Span{}
+			if nn.Op != oLOAD || err != nil {
+				return
+			}
+			name := nn.Val.(string)
+			if policy == SubstPrefix {
+				name = x + "." + name
+				nn.Val = name
+			}
+			if o, ok := owner[name]; ok && o != x && policy != SubstShare && !seen[name] {
+				err = NameCollision{name}
+			}
+			owner[name], seen[name] = x, true
+		})
+		if err != nil {
+			return nil, err
+		}
+		trees[x] = t
+	}
+	walk(ast, func(nn *AST) {
+		if nn.Op == oLOAD {
+			if t, ok := trees[nn.Val.(string)]; ok {
+				replace(nn, t.clone())
+			}
+		}
+	})
+	r := new(Expr)
+	r.set(ast)
+	return r, nil
+}
+
+// Call f on each node of a tree, parents before children. f may replace the
+// node it is given.
+func walk(nn *AST, f func(*AST)) {
+	children := nn.Children
+	f(nn)
+	for _, child := range children {
+		walk(child, f)
+	}
+}
@@ -0,0 +1,244 @@
+/*
+Copyright (c) 2013 Branden J Brown
+
+This software is provided 'as-is', without any express or implied
+warranty. In no event will the authors be held liable for any damages
+arising from the use of this software.
+
+Permission is granted to anyone to use this software for any purpose,
+including commercial applications, and to alter it and redistribute it
+freely, subject to the following restrictions:
+
+   1. The origin of this software must not be misrepresented; you must not
+   claim that you wrote the original software. If you use this software
+   in a product, an acknowledgment in the product documentation would be
+   appreciated but is not required.
+
+   2. Altered source versions must be plainly marked as such, and must not be
+   misrepresented as being the original software.
+
+   3. This notice may not be removed or altered from any source
+   distribution.
+*/
+
+package rpn
+
+import "math/big"
+
+// The statically inferred type of a value.
+type Type int
+
+const (
+	// The value may be an integer or a fraction.
+	TypeUnknown Type = iota
+	// The value is always an integer.
+	TypeInt
+	// The value is always a fraction. A variable declared with this type
+	// must be supplied as a *big.Rat, even if its value is integral.
+	TypeRat
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeInt:
+		return "int"
+	case TypeRat:
+		return "rat"
+	}
+	return "unknown"
+}
+
+type inferrer struct {
+	decls map[string]Type
+	types map[*AST]Type
+	// STORE and FOR nodes defining each binding.
+	binds map[*Binding]*AST
+	// Values of subtrees without variables. A nil constant maps to nil.
+	vals map[*AST]interface{}
+	// Depth of first operands of TRY being inferred.
+	try int
+}
+
+// Infer the type of every node in a tree. decls gives the types of variables;
+// undeclared variables have type TypeUnknown. If an integer-only operation has
+// an operand which is always a fraction, so that evaluation must fail, the
+// error is a StaticTypeError giving that operand's span. Such operands in the
+// first operand of a TRY are not errors, since it recovers from the failure.
+func Infer(root *AST, decls map[string]Type) (map[*AST]Type, error) {
+	in := inferrer{decls, make(map[*AST]Type), make(map[*Binding]*AST), make(map[*AST]interface{}), 0}
+	if err := in.infer(root); err != nil {
+		return nil, err
+	}
+	return in.types, nil
+}
+
+// Infer the type of the expression's result. See Infer.
+func (e *Expr) Type(decls map[string]Type) (Type, error) {
+	root := e.AST()
+	types, err := Infer(root, decls)
+	if err != nil {
+		return TypeUnknown, err
+	}
+	return types[root], nil
+}
+
+func (in *inferrer) infer(nn *AST) error {
+	for i, child := range nn.Children {
+		// TRY recovers from type errors in its first operand, so those are
+		// not static errors.
+		try := nn.Op == oTRY && i == 0
+		if try {
+			in.try++
+		}
+		err := in.infer(child)
+		if try {
+			in.try--
+		}
+		if err != nil {
+			return err
+		}
+	}
+	t := TypeUnknown
+	switch nn.Op {
+	case oNOP:
+		if len(nn.Children) > 0 {
+			t = in.types[nn.Children[len(nn.Children)-1]]
+		}
+	case oLOAD:
+		t = in.decls[nn.Val.(string)]
+	case oSTORE, oRECALL, oLET:
+		// These pass a value through unchanged.
+		var src *AST
+		switch nn.Op {
+		case oSTORE:
+			in.binds[nn.Val.(*Binding)] = nn
+			src = nn.Children[0]
+		case oRECALL:
+			src = in.binds[nn.Val.(*Binding)]
+		case oLET:
+			src = nn.Children[1]
+		}
+		t = in.types[src]
+		if v, ok := in.vals[src]; ok {
+			in.vals[nn] = v
+		}
+	case oFOR:
+		// The type of a FOR node is that of its index.
+		if err := in.ints(nn.Children); err != nil {
+			return err
+		}
+		in.binds[nn.Val.(*Binding)] = nn
+		t = TypeInt
+	case oSUM, oPROD:
+		if in.types[nn.Children[1]] == TypeInt {
+			t = TypeInt
+		}
+	case oCONST:
+		switch v := nn.Val.(type) {
+		case *big.Int:
+			in.vals[nn] = new(big.Int).Set(v)
+		case *big.Rat:
+			in.vals[nn] = new(big.Rat).Set(v)
+		default:
+			in.vals[nn] = nil
+		}
+	case oAND, oANDNOT, oBINOMIAL, oDIV, oGCD, oLSH, oMOD, oMODINVERSE, oMULRANGE, oNOT, oOR, oREM, oRSH, oXOR, oEXP:
+		if err := in.ints(nn.Children); err != nil {
+			return err
+		}
+		t = TypeInt
+		if nn.Op == oEXP {
+			// A negative exponent always gives a fraction, and an unknown
+			// one may.
+			t = TypeUnknown
+			if y, ok := in.vals[nn.Children[1]].(*big.Int); ok {
+				if y.Sign() >= 0 {
+					t = TypeInt
+				} else {
+					t = TypeRat
+				}
+			}
+		}
+	case oGCDN, oLCM, oDIVMOD, oEGCD, oCRT:
+		if err := in.ints(nn.Children); err != nil {
+			return err
+		}
+		t = TypeInt
+	case oMIN, oMAX, oTRY, oDEFAULT:
+		// The result is one of the operands.
+		t = in.types[nn.Children[0]]
+		for _, child := range nn.Children[1:] {
+			if in.types[child] != t {
+				t = TypeUnknown
+			}
+		}
+	case oDENOM, oNUM, oTRUNC, oFLOOR, oCEIL:
+		t = TypeInt
+	case oABS, oNEG:
+		t = in.types[nn.Children[0]]
+	case oADD, oSUB, oMUL:
+		if in.types[nn.Children[0]] == TypeInt && in.types[nn.Children[1]] == TypeInt {
+			t = TypeInt
+		}
+	case oADDN:
+		t = TypeInt
+		for _, child := range nn.Children {
+			if in.types[child] != TypeInt {
+				t = TypeUnknown
+			}
+		}
+	}
+	switch nn.Op {
+	case oNOP, oCONST, oSTORE, oRECALL, oLET, oFOR, oSUM, oPROD, oDIVMOD, oEGCD, oCRT, oTRY, oDEFAULT:
+	default:
+		if len(nn.Children) > 0 {
+			in.fold(nn)
+		}
+	}
+	if v, ok := in.vals[nn]; ok {
+		switch v.(type) {
+		case *big.Int:
+			t = TypeInt
+		case *big.Rat:
+			t = TypeRat
+		}
+	}
+	in.types[nn] = t
+	return nil
+}
+
+// Check that operands of an integer-only operation are not always fractions.
+func (in *inferrer) ints(nodes []*AST) error {
+	for _, nn := range nodes {
+		if in.types[nn] == TypeRat && in.try == 0 {
+			return StaticTypeError{"int", nn.Span}
+		}
+	}
+	return nil
+}
+
+// Compute the value of a node whose operands are all known, if it evaluates
+// successfully. Operations whose results may be huge are not computed.
+func (in *inferrer) fold(nn *AST) {
+	switch nn.Op {
+	case oEXP, oLSH, oMULRANGE, oBINOMIAL:
+		return
+	}
+	e := &Evaluator{Stack: make([]interface{}, 0, len(nn.Children)), Counts: []int{len(nn.Children)}}
+	for _, child := range nn.Children {
+		v, ok := in.vals[child]
+		if !ok {
+			return
+		}
+		switch x := v.(type) {
+		case *big.Int:
+			v = new(big.Int).Set(x)
+		case *big.Rat:
+			v = new(big.Rat).Set(x)
+		}
+		e.Stack = append(e.Stack, v)
+	}
+	if opFuncs[nn.Op](e) == nil {
+		in.vals[nn] = e.Top()
+	}
+}
@@ -24,6 +24,7 @@ freely, subject to the following restrictions:
 package rpn
 
 import (
+	"encoding/json"
 	"math/big"
 	"strings"
 )
@@ -41,6 +42,77 @@ func ParseConst(s string) (interface{}, bool) {
 	return new(big.Int).SetString(s, 0)
 }
 
+// Convert the value of a variable to a new *big.Int or *big.Rat. Integers of
+// every size become *big.Int; floating-point values are converted exactly to
+// *big.Rat, except that NaN and infinities fail; strings and json.Numbers are
+// parsed with ParseConst.
+func number(v interface{}) (interface{}, bool) {
+	switch x := v.(type) {
+	case *big.Int:
+		if x == nil {
+			return nil, false
+		}
+		return new(big.Int).Set(x), true
+	case *big.Rat:
+		if x == nil {
+			return nil, false
+		}
+		return new(big.Rat).Set(x), true
+	case int:
+		return big.NewInt(int64(x)), true
+	case int8:
+		return big.NewInt(int64(x)), true
+	case int16:
+		return big.NewInt(int64(x)), true
+	case int32:
+		return big.NewInt(int64(x)), true
+	case int64:
+		return big.NewInt(x), true
+	case uint:
+		return new(big.Int).SetUint64(uint64(x)), true
+	case uint8:
+		return new(big.Int).SetUint64(uint64(x)), true
+	case uint16:
+		return new(big.Int).SetUint64(uint64(x)), true
+	case uint32:
+		return new(big.Int).SetUint64(uint64(x)), true
+	case uint64:
+		return new(big.Int).SetUint64(x), true
+	case uintptr:
+		return new(big.Int).SetUint64(uint64(x)), true
+	case float32:
+		return floatRat(float64(x))
+	case float64:
+		return floatRat(x)
+	case *big.Float:
+		if x == nil || x.IsInf() {
+			return nil, false
+		}
+		r, _ := x.Rat(nil)
+		return r, true
+	case json.Number:
+		return parseVar(string(x))
+	case string:
+		return parseVar(x)
+	}
+	return nil, false
+}
+
+func floatRat(x float64) (interface{}, bool) {
+	r := new(big.Rat).SetFloat64(x)
+	if r == nil {
+		return nil, false
+	}
+	return r, true
+}
+
+func parseVar(s string) (interface{}, bool) {
+	if v, ok := ParseConst(strings.TrimSpace(s)); ok {
+		return v, true
+	}
+	return nil, false
+}
+
 // Panic if err is not nil; otherwise return e. Must(CompileGo(expr)) can be
 // used to compile an expression when failure is already fatal.
 func Must(e *Expr, err error) *Expr {